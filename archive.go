@@ -0,0 +1,264 @@
+// 弹幕存档相关
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/orzogc/acfundanmu"
+)
+
+// 弹幕存档格式的版本，存档格式不兼容地修改时需要增加
+const danmuArchiveVersion = 1
+
+// 弹幕存档里的事件类型
+const (
+	archiveHeader       = "header"
+	archiveComment      = "comment"
+	archiveLike         = "like"
+	archiveEnterRoom    = "enterRoom"
+	archiveFollowAuthor = "followAuthor"
+	archiveThrowBanana  = "throwBanana"
+	archiveGift         = "gift"
+	archiveRichText     = "richText"
+	archiveJoinClub     = "joinClub"
+	archiveShareLive    = "shareLive"
+)
+
+// 弹幕存档的一行
+type archiveRecord struct {
+	Version int    `json:"v"`    // 存档格式的版本
+	Type    string `json:"type"` // 事件类型
+	Time    int64  `json:"time"` // 事件发生的时间，是以毫秒为单位的Unix时间
+	Data    any    `json:"data"` // 事件的数据，和acfundanmu里对应的结构一致
+}
+
+// 弹幕存档开头的直播信息
+type archiveHeaderData struct {
+	UID        int    `json:"uid"`        // 主播uid
+	Name       string `json:"name"`       // 主播名字
+	LiveID     string `json:"liveID"`     // 直播ID
+	Title      string `json:"title"`      // 直播间标题
+	StreamName string `json:"streamName"` // 直播源名字
+	StartTime  int64  `json:"startTime"`  // 弹幕下载开始的时间，是以毫秒为单位的Unix时间
+}
+
+// 获取弹幕对应的存档事件类型
+func archiveType(d acfundanmu.DanmuMessage) string {
+	switch d.(type) {
+	case *acfundanmu.Comment:
+		return archiveComment
+	case *acfundanmu.Like:
+		return archiveLike
+	case *acfundanmu.EnterRoom:
+		return archiveEnterRoom
+	case *acfundanmu.FollowAuthor:
+		return archiveFollowAuthor
+	case *acfundanmu.ThrowBanana:
+		return archiveThrowBanana
+	case *acfundanmu.Gift:
+		return archiveGift
+	case *acfundanmu.RichText:
+		return archiveRichText
+	case *acfundanmu.JoinClub:
+		return archiveJoinClub
+	case *acfundanmu.ShareLive:
+		return archiveShareLive
+	default:
+		return ""
+	}
+}
+
+// 以JSON Lines格式写入弹幕存档
+type archiveWriter struct {
+	f   *os.File
+	gz  *gzip.Writer
+	buf *bufio.Writer
+	enc *json.Encoder
+}
+
+// 新建archiveWriter，newFile为true时覆盖写入并写入直播信息，为false时追加写入
+func newArchiveWriter(file string, s streamer, info liveInfo, isGzip, newFile bool) (*archiveWriter, error) {
+	flag := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if newFile {
+		flag = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	f, err := os.OpenFile(file, flag, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &archiveWriter{f: f}
+	var out io.Writer = f
+	// 追加写入时会新建一个gzip member，gzip.Reader默认可以读取多个member
+	if isGzip {
+		w.gz = gzip.NewWriter(f)
+		out = w.gz
+	}
+	w.buf = bufio.NewWriter(out)
+	w.enc = json.NewEncoder(w.buf)
+	w.enc.SetEscapeHTML(false)
+
+	if newFile {
+		header := archiveHeaderData{
+			UID:        s.UID,
+			Name:       s.Name,
+			LiveID:     info.LiveID,
+			Title:      info.Title,
+			StreamName: info.StreamName,
+			StartTime:  info.cfg.StartTime / 1e6,
+		}
+		err = w.enc.Encode(archiveRecord{
+			Version: danmuArchiveVersion,
+			Type:    archiveHeader,
+			Time:    header.StartTime,
+			Data:    header,
+		})
+		if err == nil {
+			err = w.flush()
+		}
+		if err != nil {
+			_ = w.close()
+			return nil, err
+		}
+	}
+
+	return w, nil
+}
+
+// 写入一条弹幕事件
+func (w *archiveWriter) writeDanmu(d acfundanmu.DanmuMessage) error {
+	t := archiveType(d)
+	if t == "" {
+		return nil
+	}
+	return w.enc.Encode(archiveRecord{
+		Version: danmuArchiveVersion,
+		Type:    t,
+		Time:    d.GetSendTime(),
+		Data:    d,
+	})
+}
+
+// 将缓存写入文件
+func (w *archiveWriter) flush() error {
+	if err := w.buf.Flush(); err != nil {
+		return err
+	}
+	if w.gz != nil {
+		return w.gz.Flush()
+	}
+	return nil
+}
+
+// 结束写入弹幕存档
+func (w *archiveWriter) close() error {
+	err := w.buf.Flush()
+	if w.gz != nil {
+		if e := w.gz.Close(); err == nil {
+			err = e
+		}
+	}
+	if e := w.f.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// 读取弹幕存档时的一行
+type archiveLine struct {
+	Version int             `json:"v"`
+	Type    string          `json:"type"`
+	Time    int64           `json:"time"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// 将存档里的事件数据转换为对应的弹幕，不支持的事件类型返回nil
+func decodeArchiveData(line *archiveLine) (acfundanmu.DanmuMessage, error) {
+	var d acfundanmu.DanmuMessage
+	switch line.Type {
+	case archiveComment:
+		d = new(acfundanmu.Comment)
+	case archiveLike:
+		d = new(acfundanmu.Like)
+	case archiveEnterRoom:
+		d = new(acfundanmu.EnterRoom)
+	case archiveFollowAuthor:
+		d = new(acfundanmu.FollowAuthor)
+	case archiveThrowBanana:
+		d = new(acfundanmu.ThrowBanana)
+	case archiveGift:
+		d = new(acfundanmu.Gift)
+	case archiveJoinClub:
+		d = new(acfundanmu.JoinClub)
+	case archiveShareLive:
+		d = new(acfundanmu.ShareLive)
+	default:
+		// richText的Segments是接口，无法直接还原
+		return nil, nil
+	}
+	if err := json.Unmarshal(line.Data, d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// 读取弹幕存档，支持gzip压缩的存档，header为存档开头的直播信息，存档没有开头时为nil
+func readArchive(file string, handle func(header *archiveHeaderData, d acfundanmu.DanmuMessage) error) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	var r io.Reader = br
+	// 根据gzip的magic number判断是否压缩
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	var header *archiveHeaderData
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var line archiveLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			return fmt.Errorf("弹幕存档 %s 第%d行的格式错误：%w", file, n, err)
+		}
+		if line.Version > danmuArchiveVersion {
+			return fmt.Errorf("弹幕存档 %s 的版本%d比本程序支持的版本%d新，请更新本程序", file, line.Version, danmuArchiveVersion)
+		}
+		if line.Type == archiveHeader {
+			header = new(archiveHeaderData)
+			if err := json.Unmarshal(line.Data, header); err != nil {
+				return fmt.Errorf("弹幕存档 %s 第%d行的格式错误：%w", file, n, err)
+			}
+			continue
+		}
+		d, err := decodeArchiveData(&line)
+		if err != nil {
+			return fmt.Errorf("弹幕存档 %s 第%d行的格式错误：%w", file, n, err)
+		}
+		if d == nil {
+			continue
+		}
+		if err := handle(header, d); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
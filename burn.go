@@ -0,0 +1,140 @@
+// 弹幕压制相关
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 弹幕压制的设置
+type burnInData struct {
+	Codec   string `json:"codec"`   // 视频编码器
+	Preset  string `json:"preset"`  // 编码器的preset，为空时不设置
+	Quality int    `json:"quality"` // 编码器的crf，越小画质越好，为0时不设置
+}
+
+// 等待弹幕下载结束的最长时间
+const recordWaitDanmu = 2 * time.Minute
+
+// 转义ffmpeg滤镜参数里的特殊字符
+func ffmpegFilterEscape(s string) string {
+	// 先转义滤镜选项的值，再转义整个滤镜
+	s = strings.NewReplacer(`\`, `\\`, `'`, `\'`, `:`, `\:`).Replace(s)
+	return strings.NewReplacer(`\`, `\\`, `'`, `\'`, `[`, `\[`, `]`, `\]`, `,`, `\,`, `;`, `\;`).Replace(s)
+}
+
+// 获取文件现在的位置，文件可能已经被移动到directory
+func (s *streamer) findFile(file string) string {
+	if _, err := os.Stat(file); err == nil {
+		return file
+	}
+	directory := config.Directory
+	if s.Directory != "" {
+		directory = s.Directory
+	}
+	if directory != "" {
+		newFile := filepath.Join(directory, filepath.Base(file))
+		if _, err := os.Stat(newFile); err == nil {
+			return newFile
+		}
+	}
+	return ""
+}
+
+// 等待弹幕下载结束后压制弹幕和剪辑精彩片段，结束后移动录播文件
+func (s streamer) processRecord(recordFile string, danmuDone <-chan struct{}) {
+	defer s.moveFile(recordFile)
+	// 不管有没有剪辑精彩片段都删除保存的时间线
+	defer loadHighlightTimeline(strings.TrimSuffix(recordFile, filepath.Ext(recordFile)))
+
+	// 录播和弹幕下载都结束后才处理
+	select {
+	case <-danmuDone:
+	case <-time.After(recordWaitDanmu):
+		lPrintErrf("等待%s的直播弹幕下载结束超时，取消压制弹幕和剪辑精彩片段", s.longID())
+		return
+	}
+
+	if s.BurnDanmu {
+		s.burnDanmu(recordFile)
+	}
+	if s.Highlight {
+		s.clipHighlights(recordFile)
+	}
+}
+
+// 将ass弹幕压制到录播文件里，生成新的视频文件
+func (s streamer) burnDanmu(recordFile string) {
+	defer func() {
+		if err := recover(); err != nil {
+			lPrintErr("Recovering from panic in burnDanmu(), the error is:", err)
+			lPrintErrf("压制%s的直播弹幕时发生错误", s.longID())
+		}
+	}()
+
+	ffmpegFile := getFFmpeg()
+	if ffmpegFile == "" {
+		return
+	}
+	if info, err := os.Stat(recordFile); err != nil || info.Size() == 0 {
+		lPrintErrf("录播文件 %s 不存在或为空，取消压制弹幕", recordFile)
+		return
+	}
+	base := strings.TrimSuffix(recordFile, filepath.Ext(recordFile))
+	assFile := s.findFile(base + ".ass")
+	if assFile == "" {
+		lPrintErrf("没有找到录播文件 %s 对应的ass弹幕文件，取消压制弹幕", recordFile)
+		return
+	}
+
+	recordFile, err := filepath.Abs(recordFile)
+	checkErr(err)
+	outFile := base + ".danmu" + filepath.Ext(recordFile)
+	outFile, err = filepath.Abs(outFile)
+	checkErr(err)
+
+	cfg := config.BurnIn
+	// 在ass文件所在的文件夹运行ffmpeg，避免滤镜里出现Windows的盘符
+	args := []string{"-hide_banner", "-nostdin", "-y",
+		"-i", recordFile,
+		"-vf", "subtitles=filename=" + ffmpegFilterEscape(filepath.Base(assFile)),
+		"-c:v", cfg.Codec}
+	if cfg.Preset != "" {
+		args = append(args, "-preset", cfg.Preset)
+	}
+	if cfg.Quality > 0 {
+		args = append(args, "-crf", strconv.Itoa(cfg.Quality))
+	}
+	args = append(args, "-c:a", "copy", outFile)
+	cmd := exec.Command(ffmpegFile, args...)
+	cmd.Dir = filepath.Dir(assFile)
+	hideCmdWindow(cmd)
+
+	lPrintln("开始压制" + s.longID() + "的直播弹幕，压制后的视频保存在" + outFile)
+	start := time.Now()
+	if out, err := cmd.CombinedOutput(); err != nil {
+		lPrintErrf("压制%s的直播弹幕失败：%v，ffmpeg的输出：%s", s.longID(), err, lastLines(string(out), 5))
+		_ = os.Remove(outFile)
+		return
+	}
+	defer s.moveFile(outFile)
+
+	lPrintf("%s的直播弹幕压制完成，用时%s", s.longID(), time.Since(start).Round(time.Second))
+	if s.Notify.NotifyRecord {
+		desktopNotify(s.Name + "的直播弹幕压制完成")
+		s.sendMirai(s.Name+"的直播弹幕压制完成", false)
+	}
+}
+
+// 获取文本的最后n行
+func lastLines(text string, n int) string {
+	lines := strings.Split(strings.TrimSpace(text), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
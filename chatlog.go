@@ -0,0 +1,203 @@
+// 弹幕聊天记录网页相关
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"html"
+	"os"
+
+	"github.com/orzogc/acfundanmu"
+)
+
+// 聊天记录网页的开头，%s为标题
+const htmlHeader = `<!DOCTYPE html>
+<html lang="zh-CN">
+<head>
+<meta charset="UTF-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>%[1]s</title>
+<style>
+body { font-family: sans-serif; margin: 0 auto; max-width: 1200px; padding: 0 1em; }
+#bar { position: sticky; top: 0; background: #fff; padding: .5em 0; border-bottom: 1px solid #ddd; }
+#search { width: 20em; padding: .3em; }
+#summary { color: #666; margin: .5em 0; }
+table { border-collapse: collapse; width: 100%%; }
+td { padding: .2em .5em; border-bottom: 1px solid #f0f0f0; vertical-align: top; }
+td.time { color: #999; font-family: monospace; white-space: nowrap; }
+td.user { white-space: nowrap; }
+.medal { font-size: .8em; color: #fff; background: #e77; border-radius: .3em; padding: 0 .3em; margin-left: .3em; }
+.manager { font-size: .8em; color: #fff; background: #69c; border-radius: .3em; padding: 0 .3em; margin-left: .3em; }
+tr.gift td.content { color: #c60; }
+tr.enterRoom td.content, tr.joinClub td.content { color: #999; }
+tr.hide { display: none; }
+</style>
+</head>
+<body>
+<h2>%[1]s</h2>
+<div id="bar">
+<input id="search" type="search" placeholder="搜索用户名字、uid或内容">
+<label><input type="checkbox" data-type="comment" checked>弹幕</label>
+<label><input type="checkbox" data-type="gift" checked>礼物</label>
+<label><input type="checkbox" data-type="enterRoom">进入直播间</label>
+<label><input type="checkbox" data-type="joinClub" checked>加入守护团</label>
+<div id="summary"></div>
+</div>
+<table>
+<tbody id="log">
+`
+
+// 聊天记录网页的结尾，搜索和礼物统计都在浏览器里进行
+const htmlFooter = `</tbody>
+</table>
+<script>
+(function () {
+  var rows = Array.prototype.slice.call(document.querySelectorAll("#log tr"));
+  var search = document.getElementById("search");
+  var boxes = Array.prototype.slice.call(document.querySelectorAll("#bar input[type=checkbox]"));
+  function update() {
+    var word = search.value.trim().toLowerCase();
+    var show = {};
+    boxes.forEach(function (b) { show[b.dataset.type] = b.checked; });
+    var count = 0;
+    rows.forEach(function (r) {
+      var visible = show[r.className.split(" ")[0]] && (word === "" || r.textContent.toLowerCase().indexOf(word) !== -1);
+      r.classList.toggle("hide", !visible);
+      if (visible) count++;
+    });
+    var ac = 0, banana = 0, users = {};
+    rows.forEach(function (r) {
+      if (r.classList.contains("gift")) {
+        ac += parseFloat(r.dataset.ac || 0);
+        banana += parseInt(r.dataset.banana || 0, 10);
+        users[r.dataset.uid] = true;
+      }
+    });
+    document.getElementById("summary").textContent = "显示" + count + "/" + rows.length + "条，共" +
+      Object.keys(users).length + "人送出礼物，价值" + ac.toFixed(1) + "AC币和" + banana + "香蕉";
+  }
+  search.addEventListener("input", update);
+  boxes.forEach(function (b) { b.addEventListener("change", update); });
+  update();
+})();
+</script>
+</body>
+</html>
+`
+
+// 聊天记录网页里的一行，依次为类型、额外的属性、时间、用户、内容
+const htmlRow = `<tr class="%s" data-uid="%d"%s><td class="time">%s</td><td class="user">%s</td><td class="content">%s</td></tr>
+`
+
+// 写入可以搜索的弹幕聊天记录网页
+type htmlWriter struct {
+	f         *os.File
+	buf       *bufio.Writer
+	startTime int64 // 直播开始的时间，是以纳秒为单位的Unix时间
+}
+
+// 新建htmlWriter，newFile为true时覆盖写入，为false时在原有记录后面追加写入
+func newHTMLWriter(file string, info liveInfo, newFile bool) (*htmlWriter, error) {
+	w := &htmlWriter{startTime: info.cfg.StartTime}
+
+	var err error
+	if newFile {
+		w.f, err = os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			return nil, err
+		}
+		w.buf = bufio.NewWriter(w.f)
+		if _, err = fmt.Fprintf(w.buf, htmlHeader, html.EscapeString(info.cfg.Title)); err != nil {
+			_ = w.f.Close()
+			return nil, err
+		}
+		return w, nil
+	}
+
+	w.f, err = os.OpenFile(file, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	// 去掉网页的结尾
+	if err = truncateSuffix(w.f, htmlFooter); err != nil {
+		_ = w.f.Close()
+		return nil, err
+	}
+	w.buf = bufio.NewWriter(w.f)
+	return w, nil
+}
+
+// 获取相对于直播开始的时间
+func (w *htmlWriter) timeString(sendTime int64) string {
+	d := (sendTime*1e6 - w.startTime) / 1e9
+	if d < 0 {
+		d = 0
+	}
+	return fmt.Sprintf("%02d:%02d:%02d", d/3600, d/60%60, d%60)
+}
+
+// 获取用户名字和守护徽章
+func htmlUser(u acfundanmu.UserInfo) string {
+	user := html.EscapeString(u.Nickname)
+	if u.Medal.ClubName != "" {
+		user += fmt.Sprintf(`<span class="medal">%s %d</span>`, html.EscapeString(u.Medal.ClubName), u.Medal.Level)
+	}
+	if u.ManagerType == acfundanmu.NormalManager {
+		user += `<span class="manager">房管</span>`
+	}
+	return user
+}
+
+// 写入一条弹幕，只写入弹幕、礼物、进入直播间和加入守护团
+func (w *htmlWriter) writeDanmu(d acfundanmu.DanmuMessage) error {
+	var err error
+	switch d := d.(type) {
+	case *acfundanmu.Comment:
+		_, err = fmt.Fprintf(w.buf, htmlRow, archiveComment, d.UserID, "",
+			w.timeString(d.SendTime), htmlUser(d.UserInfo), html.EscapeString(d.Content))
+	case *acfundanmu.Gift:
+		count := d.Count * d.Combo
+		if count == 0 {
+			count = d.Count
+		}
+		var attr, value string
+		if d.PayWalletType == 1 {
+			ac := float64(d.Value) / 1000
+			attr = fmt.Sprintf(` data-ac="%g"`, ac)
+			value = fmt.Sprintf("%gAC币", ac)
+		} else {
+			attr = fmt.Sprintf(` data-banana="%d"`, d.Value)
+			value = fmt.Sprintf("%d香蕉", d.Value)
+		}
+		content := fmt.Sprintf("送出%d个%s（价值%s）", count, html.EscapeString(d.GiftName), value)
+		_, err = fmt.Fprintf(w.buf, htmlRow, archiveGift, d.UserID, attr,
+			w.timeString(d.SendTime), htmlUser(d.UserInfo), content)
+	case *acfundanmu.ThrowBanana:
+		_, err = fmt.Fprintf(w.buf, htmlRow, archiveGift, d.UserID, fmt.Sprintf(` data-banana="%d"`, d.BananaCount),
+			w.timeString(d.SendTime), htmlUser(d.UserInfo), fmt.Sprintf("投了%d个香蕉", d.BananaCount))
+	case *acfundanmu.EnterRoom:
+		_, err = fmt.Fprintf(w.buf, htmlRow, archiveEnterRoom, d.UserID, "",
+			w.timeString(d.SendTime), htmlUser(d.UserInfo), "进入直播间")
+	case *acfundanmu.JoinClub:
+		_, err = fmt.Fprintf(w.buf, htmlRow, archiveJoinClub, d.FansInfo.UserID, "",
+			w.timeString(d.JoinTime), htmlUser(d.FansInfo), "加入守护团")
+	}
+	return err
+}
+
+// 将缓存写入文件
+func (w *htmlWriter) flush() error {
+	return w.buf.Flush()
+}
+
+// 写入网页结尾并结束写入聊天记录
+func (w *htmlWriter) close() error {
+	_, err := w.buf.WriteString(htmlFooter)
+	if e := w.buf.Flush(); err == nil {
+		err = e
+	}
+	if e := w.f.Close(); err == nil {
+		err = e
+	}
+	return err
+}
@@ -31,16 +31,32 @@ var (
 
 // 主播的设置数据
 type streamer struct {
-	UID         int     `json:"uid"`         // 主播uid
-	Name        string  `json:"name"`        // 主播名字
-	Notify      notify  `json:"notify"`      // 开播提醒相关
-	Record      bool    `json:"record"`      // 是否自动下载直播视频
-	Danmu       bool    `json:"danmu"`       // 是否自动下载直播弹幕
-	KeepOnline  bool    `json:"keepOnline"`  // 是否在该主播的直播间挂机，目前主要用于挂粉丝牌等级
-	Bitrate     int     `json:"bitrate"`     // 下载直播视频的最高码率
-	Directory   string  `json:"directory"`   // 直播视频和弹幕下载结束后会被移动到该文件夹，会覆盖config.json里的设置
-	SendQQ      []int64 `json:"sendQQ"`      // 给这些QQ号发送消息，会覆盖config.json里的设置
-	SendQQGroup []int64 `json:"sendQQGroup"` // 给这些QQ群发送消息，会覆盖config.json里的设置
+	UID              int          `json:"uid"`              // 主播uid
+	Name             string       `json:"name"`             // 主播名字
+	Notify           notify       `json:"notify"`           // 开播提醒相关
+	Record           bool         `json:"record"`           // 是否自动下载直播视频
+	Danmu            bool         `json:"danmu"`            // 是否自动下载直播弹幕
+	DanmuFormat      []string     `json:"danmuFormat"`      // 下载直播弹幕时输出的弹幕文件格式，有ass、xml、srt、vtt和html，为空时只输出ass
+	ASSStyle         assStyleData `json:"assStyle"`         // ass弹幕字幕的样式，会覆盖根据视频分辨率得到的设置
+	DanmuArchive     bool         `json:"danmuArchive"`     // 下载直播弹幕时是否将全部弹幕事件保存为JSON Lines格式的存档
+	DanmuArchiveGzip bool         `json:"danmuArchiveGzip"` // 是否用gzip压缩弹幕存档
+	DanmuStatsQQ     bool         `json:"danmuStatsQQ"`     // 直播弹幕下载结束时是否将弹幕统计发送到QQ
+	GiftLedger       bool         `json:"giftLedger"`       // 是否将直播收到的礼物记录到礼物账本，不需要下载直播弹幕
+	Metrics          bool         `json:"metrics"`          // 是否定时记录直播间的在线观众数量、点赞数等观众数据，不需要下载直播弹幕
+	KeepOnline       bool         `json:"keepOnline"`       // 是否在该主播的直播间挂机，目前主要用于挂粉丝牌等级
+	BurnDanmu        bool         `json:"burnDanmu"`        // 下载直播视频和弹幕结束后是否将ass弹幕压制到视频里，生成新的视频文件
+	Highlight        bool         `json:"highlight"`        // 下载直播视频和弹幕结束后是否根据弹幕和礼物密度剪辑精彩片段
+	QualityCheck     bool         `json:"qualityCheck"`     // 下载直播视频时是否检测黑屏、画面静止和无声
+	Moderate         bool         `json:"moderate"`         // 是否在该主播的直播间自动执行房管规则，需要登陆AcFun帐号并且是该直播间的房管或主播
+	ModerateDryRun   bool         `json:"moderateDryRun"`   // 是否只记录房管规则将要进行的操作，不真正踢人
+	Filter           filterData   `json:"filter"`           // 弹幕过滤的设置，会加到config.json的设置上
+	Watch            watchData    `json:"watch"`            // 弹幕关键词和用户提醒的规则，需要下载直播弹幕或在直播间挂机
+	ModerateRule     moderateData `json:"moderateRule"`     // 房管规则
+	Bitrate          int          `json:"bitrate"`          // 下载直播视频的最高码率
+	Directory        string       `json:"directory"`        // 直播视频和弹幕下载结束后会被移动到该文件夹，会覆盖config.json里的设置
+	Proxy            string       `json:"proxy"`            // 下载直播视频使用的代理，会覆盖config.json里的设置，为direct时不使用代理
+	SendQQ           []int64      `json:"sendQQ"`           // 给这些QQ号发送消息，会覆盖config.json里的设置
+	SendQQGroup      []int64      `json:"sendQQGroup"`      // 给这些QQ群发送消息，会覆盖config.json里的设置
 }
 
 // 存放主播的设置数据
@@ -52,13 +68,26 @@ var streamers struct {
 
 // 设置数据
 type configData struct {
-	Source         string    `json:"source"`         // 直播源，有hls和flv两种
-	Output         string    `json:"output"`         // 直播下载视频格式的后缀名
-	WebPort        int       `json:"webPort"`        // web API的本地端口
-	Directory      string    `json:"directory"`      // 直播视频和弹幕下载结束后会被移动到该文件夹，会被live.json里的设置覆盖
-	Acfun          acfunUser `json:"acfun"`          // AcFun帐号相关
-	AutoKeepOnline bool      `json:"autoKeepOnline"` // 是否自动在有守护徽章的直播间挂机
-	Mirai          miraiData `json:"mirai"`          // Mirai相关设置
+	Source          string        `json:"source"`          // 直播源，有hls和flv两种
+	Output          string        `json:"output"`          // 直播下载视频格式的后缀名
+	WebPort         int           `json:"webPort"`         // web API的本地端口
+	Directory       string        `json:"directory"`       // 直播视频和弹幕下载结束后会被移动到该文件夹，会被live.json里的设置覆盖
+	Acfun           acfunUser     `json:"acfun"`           // AcFun帐号相关
+	AutoKeepOnline  bool          `json:"autoKeepOnline"`  // 是否自动在有守护徽章的直播间挂机
+	Mirai           miraiData     `json:"mirai"`           // Mirai相关设置
+	Quality         qualityData   `json:"quality"`         // 直播画面和声音质量检测相关设置
+	TextSub         textSubData   `json:"textSub"`         // srt和vtt弹幕字幕相关设置
+	WatchInterval   float64       `json:"watchInterval"`   // 同一个直播间两次弹幕提醒的最小间隔秒数
+	Filter          filterData    `json:"filter"`          // 所有主播的弹幕过滤的设置
+	BurnIn          burnInData    `json:"burnIn"`          // 弹幕压制相关设置
+	MetricsInterval float64       `json:"metricsInterval"` // 记录直播间观众数据的间隔秒数
+	Highlight       highlightData `json:"highlight"`       // 精彩片段剪辑相关设置
+	RoomPageSize    int           `json:"roomPageSize"`    // 分页获取AcFun直播间列表时每页的数量
+	Interval        intervalData  `json:"interval"`        // 各种循环的间隔和失败重试相关设置
+	RateLimit       rateLimitData `json:"rateLimit"`       // 请求AcFun接口的限速设置
+	Proxy           string        `json:"proxy"`           // 连接AcFun使用的代理，支持http和socks5，为空时不使用代理
+	Endpoints       endpointData  `json:"endpoints"`       // AcFun接口的地址，可以改为模拟AcFun服务器的地址
+	Schedule        scheduleData  `json:"schedule"`        // 根据直播历史统计直播时间表相关设置
 }
 
 // 默认设置
@@ -79,6 +108,61 @@ var config = configData{
 		SendQQ:        []int64{},
 		SendQQGroup:   []int64{},
 	},
+	Quality: qualityData{
+		BlackDuration:   10,
+		FreezeDuration:  30,
+		SilenceDuration: 30,
+		SilenceNoise:    -50,
+		AlertInterval:   600,
+	},
+	TextSub: textSubData{
+		MaxLines: 3,
+		Duration: 5,
+	},
+	WatchInterval:   60,
+	MetricsInterval: 30,
+	RoomPageSize:    1000,
+	Interval: intervalData{
+		FetchRooms: 10,
+		Medals:     60,
+		Retry:      2,
+		MaxBackoff: 300,
+	},
+	RateLimit: rateLimitData{
+		Rate:  5,
+		Burst: 10,
+	},
+	Endpoints: endpointData{
+		Live:   "https://live.acfun.cn",
+		Main:   "https://www.acfun.cn",
+		Mobile: "https://m.acfun.cn",
+		Zt:     "https://api.kuaishouzt.com",
+		Mock:   false,
+	},
+	Schedule: scheduleData{
+		Weeks:      8,
+		Regular:    0.6,
+		WarnMissed: false,
+		Grace:      60,
+	},
+	Highlight: highlightData{
+		Clips:      5,
+		Window:     60,
+		Padding:    15,
+		GiftWeight: 2,
+	},
+	BurnIn: burnInData{
+		Codec:   "libx264",
+		Preset:  "veryfast",
+		Quality: 23,
+	},
+	Filter: filterData{
+		BlockUIDs:     []int64{},
+		BlockKeywords: []string{},
+		BlockRegexps:  []string{},
+		DedupWindow:   0,
+		MaxLength:     0,
+	},
 }
 
 // AcFun用户帐号数据
@@ -128,6 +212,20 @@ func getStreamers() []streamer {
 		if s.SendQQGroup == nil {
 			s.SendQQGroup = []int64{}
 		}
+		if s.DanmuFormat == nil {
+			s.DanmuFormat = []string{}
+		}
+		s.Filter.normalize()
+		if s.Watch.Keywords == nil {
+			s.Watch.Keywords = []string{}
+		}
+		if s.Watch.Regexps == nil {
+			s.Watch.Regexps = []string{}
+		}
+		if s.Watch.UIDs == nil {
+			s.Watch.UIDs = []int64{}
+		}
+		s.ModerateRule.normalize()
 		ss = append(ss, s)
 	}
 	streamers.RUnlock()
@@ -165,6 +263,14 @@ func loadLiveConfig() {
 			checkErr(err)
 			news := make(map[int]streamer)
 			for _, s := range ss {
+				for _, format := range s.DanmuFormat {
+					if !isDanmuFormat(format) {
+						lPrintErrf("%s里uid为%d的主播的danmuFormat有未知的弹幕格式，不会输出该格式：%s", liveFile, s.UID, format)
+					}
+				}
+				if err := s.checkProxy(); err != nil {
+					lPrintErrf("%s里uid为%d的主播的proxy设置错误，无法下载其直播视频：%v", liveFile, s.UID, err)
+				}
 				s.SendQQ = removeDup(s.SendQQ)
 				s.SendQQGroup = removeDup(s.SendQQGroup)
 				news[s.UID] = s
@@ -336,6 +442,18 @@ func loadNewConfig() {
 	streamers.Unlock()
 }
 
+// 获取文件下载结束并移动后的路径
+func (s *streamer) movedFile(file string) string {
+	directory := config.Directory
+	if s.Directory != "" {
+		directory = s.Directory
+	}
+	if directory == "" {
+		return file
+	}
+	return filepath.Join(directory, filepath.Base(file))
+}
+
 // 移动文件
 func (s *streamer) moveFile(oldFile string) {
 	if oldFile == "" {
@@ -0,0 +1,141 @@
+// 弹幕存档转换相关
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/orzogc/acfundanmu"
+)
+
+// 弹幕存档转换的设置
+type convertOption struct {
+	format   string         // 输出的弹幕文件格式
+	resX     int            // 视频分辨率
+	resY     int            // 视频分辨率
+	fontSize int            // 字体大小，为0时根据分辨率自动设置
+	offset   time.Duration  // 弹幕时间的偏移，为正时弹幕延后出现
+	exclude  *regexp.Regexp // 去掉内容符合该正则表达式的弹幕
+	force    bool           // 转换后的文件已经存在时是否覆盖
+}
+
+// 获取转换后的弹幕文件路径
+func convertedFile(archiveFile, format string) string {
+	file := strings.TrimSuffix(archiveFile, ".gz")
+	file = strings.TrimSuffix(file, filepath.Ext(file))
+	return file + "." + format
+}
+
+// 根据分辨率获取字幕设置
+func subConfigByRes(resX, resY, fontSize int) acfundanmu.SubConfig {
+	cfg := acfundanmu.SubConfig{PlayResX: resX, PlayResY: resY, FontSize: fontSize}
+	if cfg.FontSize == 0 {
+		cfg.FontSize = resY / 18
+		if cfg.FontSize < 1 {
+			cfg.FontSize = 1
+		}
+		for _, c := range subConfigs {
+			if c.PlayResX == resX && c.PlayResY == resY {
+				cfg.FontSize = c.FontSize
+				break
+			}
+		}
+	}
+	return cfg
+}
+
+// 新建转换时使用的弹幕输出
+func newConvertWriter(file string, info liveInfo, format string) (danmuWriter, error) {
+	switch format {
+	case danmuFormatASS:
+		return newASSWriter(file, info, true)
+	case danmuFormatXML:
+		return newXMLWriter(file, info, true)
+	case danmuFormatSRT:
+		return newTextSubWriter(file, info, false, true)
+	case danmuFormatVTT:
+		return newTextSubWriter(file, info, true, true)
+	case danmuFormatHTML:
+		return newHTMLWriter(file, info, true)
+	default:
+		return nil, fmt.Errorf("不支持的弹幕格式：%s", format)
+	}
+}
+
+// 将弹幕存档转换为其他格式的弹幕文件，不需要连接AcFun，返回转换后的文件路径
+func convertDanmu(archiveFile string, opt convertOption) (outFile string, e error) {
+	defer func() {
+		if err := recover(); err != nil {
+			e = fmt.Errorf("convertDanmu() error: %v", err)
+		}
+	}()
+
+	outFile = convertedFile(archiveFile, opt.format)
+	if outFile == archiveFile {
+		return "", fmt.Errorf("转换后的文件和弹幕存档 %s 相同", archiveFile)
+	}
+	// 下载弹幕时已经生成了同名的弹幕文件
+	if _, err := os.Stat(outFile); err == nil && !opt.force {
+		return "", fmt.Errorf("文件 %s 已经存在，如要覆盖请加上 -force", outFile)
+	}
+
+	var w danmuWriter
+	var filter *danmuFilter
+	var count int
+	err := readArchive(archiveFile, func(header *archiveHeaderData, d acfundanmu.DanmuMessage) error {
+		if w == nil {
+			var info liveInfo
+			var s streamer
+			info.cfg = subConfigByRes(opt.resX, opt.resY, opt.fontSize)
+			info.cfg.Title = filepath.Base(strings.TrimSuffix(outFile, filepath.Ext(outFile)))
+			// 没有直播信息时以第一条弹幕的时间作为开始时间
+			startTime := d.GetSendTime()
+			if header != nil {
+				info.LiveID = header.LiveID
+				info.StreamName = header.StreamName
+				startTime = header.StartTime
+				// 使用live.json里该主播的弹幕过滤设置
+				var ok bool
+				if s, ok = getStreamer(header.UID); !ok {
+					s = streamer{UID: header.UID, Name: header.Name}
+				}
+			}
+			filter = s.newDanmuFilter()
+			info.cfg.StartTime = startTime*1e6 - int64(opt.offset)
+			var err error
+			w, err = newConvertWriter(outFile, info, opt.format)
+			if err != nil {
+				return err
+			}
+		}
+		if c, ok := d.(*acfundanmu.Comment); ok && opt.exclude != nil && opt.exclude.MatchString(c.Content) {
+			return nil
+		}
+		if filter.isBlocked(d) {
+			return nil
+		}
+		count++
+		return w.writeDanmu(d)
+	})
+	if w != nil {
+		if e := w.close(); err == nil {
+			err = e
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	if w == nil {
+		return "", fmt.Errorf("弹幕存档 %s 里没有弹幕", archiveFile)
+	}
+
+	lPrintf("成功将弹幕存档 %s 里的%d条弹幕事件转换为 %s", archiveFile, count, outFile)
+	if filter.dropped != 0 {
+		lPrintf("转换时根据弹幕过滤设置过滤了%d条弹幕", filter.dropped)
+	}
+	return outFile, nil
+}
@@ -28,7 +28,63 @@ func (s *streamer) handleMsg(msg controlMsg) {
 	}
 }
 
-// 循环获取指定主播的直播状态，通知开播和自动下载直播
+// 直播状态变化的事件类型
+type liveEventType int
+
+const (
+	liveOn       liveEventType = iota // 开播
+	liveOff                           // 下播
+	titleChanged                      // 修改直播间标题
+)
+
+// 直播状态变化的事件
+type liveEvent struct {
+	t      liveEventType // 事件类型
+	liveID string        // 直播ID
+	name   string        // 主播名字
+	title  string        // 直播间标题
+}
+
+// 对比新旧直播间列表，获取直播状态变化的事件
+func diffRooms(oldRooms, newRooms map[int]*liveRoom) map[int]liveEvent {
+	events := make(map[int]liveEvent)
+	for uid, room := range newRooms {
+		if old, ok := oldRooms[uid]; !ok || old.liveID != room.liveID {
+			events[uid] = liveEvent{t: liveOn, liveID: room.liveID, name: room.name, title: room.title}
+		} else if old.title != room.title {
+			events[uid] = liveEvent{t: titleChanged, liveID: room.liveID, name: room.name, title: room.title}
+		}
+	}
+	for uid, room := range oldRooms {
+		if _, ok := newRooms[uid]; !ok {
+			events[uid] = liveEvent{t: liveOff, liveID: room.liveID, name: room.name, title: room.title}
+		}
+	}
+	return events
+}
+
+// 将直播状态变化的事件发送给监听的主播，每个主播只保留最新的一个事件，不会丢弃开播和下播
+func publishLiveEvents(events map[int]liveEvent) {
+	sInfoMap.Lock()
+	defer sInfoMap.Unlock()
+	for uid, e := range events {
+		if m, ok := sInfoMap.info[uid]; ok && m.events != nil {
+			// 还没有处理的事件和新事件合并，开播和下播的事件会让监听重新检查直播间列表
+			select {
+			case old := <-m.events:
+				if e.t == titleChanged && old.t != titleChanged {
+					old.title = e.title
+					e = old
+				}
+			default:
+			}
+			// 只有这里会发送事件，并且已经持有sInfoMap的锁，所以不会阻塞
+			m.events <- e
+		}
+	}
+}
+
+// 监听指定主播的直播状态变化事件，通知开播和自动下载直播
 func (s streamer) cycle(liveID string) {
 	defer func() {
 		if err := recover(); err != nil {
@@ -40,20 +96,28 @@ func (s streamer) cycle(liveID string) {
 		}
 	}()
 
+	// 设置文件里有该主播，但是不通知不下载
+	active := s.Notify.NotifyOn || s.Notify.NotifyOff || s.Notify.NotifyRecord || s.Notify.NotifyDanmu || s.Record || s.Danmu || s.KeepOnline ||
+		s.GiftLedger || s.Metrics || s.Moderate
+
 	ch := make(chan controlMsg, 20)
+	var events chan liveEvent
+	if active {
+		events = make(chan liveEvent, 1)
+	}
 	var modify bool
 	sInfoMap.Lock()
 	if m, ok := sInfoMap.info[s.UID]; ok {
 		m.ch = ch
+		m.events = events
 		modify = m.modify
 		m.modify = false
 	} else {
-		sInfoMap.info[s.UID] = &streamerInfo{ch: ch}
+		sInfoMap.info[s.UID] = &streamerInfo{ch: ch, events: events}
 	}
 	sInfoMap.Unlock()
 
-	// 设置文件里有该主播，但是不通知不下载
-	if !(s.Notify.NotifyOn || s.Notify.NotifyOff || s.Notify.NotifyRecord || s.Notify.NotifyDanmu || s.Record || s.Danmu || s.KeepOnline) {
+	if !active {
 		for {
 			msg := <-ch
 			s.handleMsg(msg)
@@ -64,67 +128,98 @@ func (s streamer) cycle(liveID string) {
 	lPrintln("开始监听" + s.longID() + "的直播状态")
 
 	var isLive bool
-	for {
-		select {
-		case msg := <-ch:
-			msg.liveID = liveID
-			s.handleMsg(msg)
+	// 需要重新检查直播状态时不为nil
+	var recheck <-chan time.Time
+
+	// 处理开播
+	onLive := func(newLiveID string) {
+		isLive = true
+		if newLiveID == "" {
+			lPrintErrf("无法获取%s的liveID", s.longID())
+			recheck = time.After(seconds(config.Interval.Retry))
 			return
-		default:
-			if s.isLiveOn() {
-				isLive = true
-				newLiveID := s.getLiveID()
-				if newLiveID == "" {
-					lPrintErrf("无法获取%s的liveID", s.longID())
-					time.Sleep(time.Second)
-					continue
-				}
+		}
 
-				if liveID != newLiveID || modify {
-					liveID = newLiveID
-					modify = false
-					title := s.getTitle()
-					lPrintln(s.longID() + "正在直播：" + title)
-					lPrintln(s.Name + "的直播观看地址：" + s.getURL())
+		if liveID != newLiveID || modify {
+			liveID = newLiveID
+			modify = false
+			title := s.getTitle()
+			lPrintln(s.longID() + "正在直播：" + title)
+			lPrintln(s.Name + "的直播观看地址：" + s.getURL())
 
-					if s.Notify.NotifyOn {
-						desktopNotify(s.Name + "正在直播：" + title)
-						s.sendMirai(fmt.Sprintf("%s正在直播：%s，观看地址：%s", s.Name, title, s.getURL()), true)
-					}
+			if s.Notify.NotifyOn {
+				desktopNotify(s.Name + "正在直播：" + title)
+				s.sendMirai(fmt.Sprintf("%s正在直播：%s，观看地址：%s", s.Name, title, s.getURL()), true)
+			}
 
-					info, _ := getLiveInfo(liveID)
+			info, _ := getLiveInfo(liveID)
 
-					// 优先级：录播 > 弹幕/挂机
-					if s.Record && !info.isRecording {
-						go s.recordLive(s.Danmu || s.KeepOnline)
-					} else {
-						lPrintf("如果要临时下载%s的直播视频，可以运行 startrecord %d 或 startrecdan %d", s.Name, s.UID, s.UID)
-						// 不下载直播视频时下载弹幕
-						if (s.Danmu && !info.isDanmu) || (s.KeepOnline && !info.isKeepOnline) {
-							filename := getTime() + " " + s.Name + " " + title
-							go s.initDanmu(mainCtx, liveID, filename)
-						}
-					}
-				}
+			// 优先级：录播 > 弹幕/挂机
+			if s.Record && !info.isRecording {
+				go s.recordLive(s.Danmu || s.KeepOnline || s.GiftLedger || s.Metrics || s.Moderate)
 			} else {
-				// 应付AcFun API可能出现的bug：主播没下播但API显示下播
-				if isLive && !s.isLiveOnByPage() {
-					isLive = false
-					lPrintln(s.longID() + "已经下播")
-					if s.Notify.NotifyOff {
-						msg := s.Name + "已经下播"
-						desktopNotify(msg)
-						s.sendMirai(msg, true)
-					}
+				lPrintf("如果要临时下载%s的直播视频，可以运行 startrecord %d 或 startrecdan %d", s.Name, s.UID, s.UID)
+				// 不下载直播视频时下载弹幕、记录礼物或观众数据、执行房管规则
+				if (s.Danmu && !info.isDanmu) || (s.KeepOnline && !info.isKeepOnline) || (s.GiftLedger && !info.isGiftLedger) ||
+					(s.Metrics && !info.isMetrics) || (s.Moderate && !info.isModerate) {
+					filename := getTime() + " " + s.Name + " " + title
+					go s.initDanmu(mainCtx, liveID, filename, nil)
 				}
 			}
 		}
+	}
+
+	// 处理下播
+	onOffline := func() {
+		if !isLive {
+			return
+		}
+		// 应付AcFun API可能出现的bug：主播没下播但API显示下播，过一段时间再检查
+		if s.isLiveOnByPage() {
+			recheck = time.After(10 * time.Second)
+			return
+		}
+		isLive = false
+		lPrintln(s.longID() + "已经下播")
+		if s.Notify.NotifyOff {
+			msg := s.Name + "已经下播"
+			desktopNotify(msg)
+			s.sendMirai(msg, true)
+		}
+	}
 
-		time.Sleep(time.Second)
+	// 检查现在的直播状态
+	check := func() {
+		if s.isLiveOn() {
+			onLive(s.getLiveID())
+		} else {
+			onOffline()
+		}
+	}
+
+	check()
+	for {
+		select {
+		case msg := <-ch:
+			msg.liveID = liveID
+			s.handleMsg(msg)
+			return
+		case e := <-events:
+			switch e.t {
+			case liveOn, liveOff:
+				// 事件可能被合并，以现在的直播间列表为准
+				check()
+			case titleChanged:
+				lPrintln(s.longID() + "修改了直播间标题：" + e.title)
+			}
+		case <-recheck:
+			recheck = nil
+			check()
+		}
 	}
 }
 
-// 循环检测删除lInfoMap.info里没有下载视频和弹幕以及不在挂机的key
+// 循环检测删除lInfoMap.info里没有下载视频和弹幕、不在挂机、没有记录礼物和观众数据以及没有执行房管规则的key
 func cycleDelKey(ctx context.Context) {
 	for {
 		select {
@@ -133,7 +228,7 @@ func cycleDelKey(ctx context.Context) {
 		default:
 			lInfoMap.Lock()
 			for liveID, info := range lInfoMap.info {
-				if !(info.isRecording || info.isDanmu || info.isKeepOnline) {
+				if !(info.isRecording || info.isDanmu || info.isKeepOnline || info.isGiftLedger || info.isMetrics || info.isModerate) {
 					delete(lInfoMap.info, liveID)
 				}
 			}
@@ -147,27 +242,36 @@ func cycleDelKey(ctx context.Context) {
 
 // 循环获取AcFun直播间数据
 func cycleFetch(ctx context.Context) {
+	var b backoff
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		default:
-			if ok := fetchAllRooms(); ok {
+			ok := fetchAllRooms()
+			if ok {
 				if len(liveRooms.newRooms) == 0 {
 					lPrintWarn("没有人在直播")
 				}
 
 				liveRooms.Lock()
+				events := diffRooms(liveRooms.rooms, liveRooms.newRooms)
 				for uid, room := range liveRooms.rooms {
 					delete(liveRooms.rooms, uid)
 					liveRoomPool.Put(room)
 				}
 				liveRooms.rooms = liveRooms.newRooms
 				liveRooms.Unlock()
+
+				// 更新直播间列表后才发送事件
+				publishLiveEvents(events)
+				recordHistory(events)
 			}
 
-			// 每10秒循环一次
-			time.Sleep(10 * time.Second)
+			// 失败时退避
+			if !sleepCtx(ctx, b.next(ok, seconds(config.Interval.FetchRooms))) {
+				return
+			}
 		}
 	}
 }
@@ -186,6 +290,7 @@ func cycleGetMedals(ctx context.Context) {
 		return
 	}
 
+	var b backoff
 	for {
 		select {
 		case <-ctx.Done():
@@ -222,8 +327,10 @@ func cycleGetMedals(ctx context.Context) {
 				lPrintErrf("%+v", err)
 			}
 
-			// 每分钟循环一次
-			time.Sleep(time.Minute)
+			// 失败时退避
+			if !sleepCtx(ctx, b.next(err == nil, seconds(config.Interval.Medals))) {
+				return
+			}
 		}
 	}
 }
@@ -5,6 +5,7 @@ import (
 	"context"
 	"fmt"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/orzogc/acfundanmu"
@@ -18,8 +19,262 @@ var subConfigs = map[int]acfundanmu.SubConfig{
 	1080: {PlayResX: 1920, PlayResY: 1080, FontSize: 60},
 }
 
-// 下载直播弹幕
-func (s streamer) getDanmu(ctx context.Context, info liveInfo) {
+// 弹幕文件的格式
+const (
+	danmuFormatASS  = "ass"  // ass字幕
+	danmuFormatXML  = "xml"  // Bilibili格式的xml弹幕
+	danmuFormatSRT  = "srt"  // srt字幕
+	danmuFormatVTT  = "vtt"  // WebVTT字幕
+	danmuFormatHTML = "html" // 可以搜索的聊天记录网页
+)
+
+// 弹幕输出的接口
+type danmuWriter interface {
+	writeDanmu(d acfundanmu.DanmuMessage) error // 写入一条弹幕
+	flush() error                               // 将缓存写入文件
+	close() error                               // 结束写入
+}
+
+// 获取弹幕文件的路径，ext为后缀名
+func (info *liveInfo) danmuFile(ext string) string {
+	return strings.TrimSuffix(info.assFile, ".ass") + ext
+}
+
+// 获取弹幕存档文件的路径
+func (s *streamer) archiveFile(info liveInfo) string {
+	if s.DanmuArchiveGzip {
+		return info.danmuFile(".jsonl.gz")
+	}
+	return info.danmuFile(".jsonl")
+}
+
+// 是否支持的弹幕文件格式
+func isDanmuFormat(format string) bool {
+	switch format {
+	case danmuFormatASS, danmuFormatXML, danmuFormatSRT, danmuFormatVTT, danmuFormatHTML:
+		return true
+	default:
+		return false
+	}
+}
+
+// 获取要输出的弹幕文件格式，没有设置时默认为ass，总是会输出html聊天记录，忽略未知的格式
+func (s *streamer) danmuFormats() []string {
+	var formats []string
+	hasHTML := false
+	for _, format := range s.DanmuFormat {
+		if isDanmuFormat(format) {
+			formats = append(formats, format)
+			hasHTML = hasHTML || format == danmuFormatHTML
+		}
+	}
+	if len(formats) == 0 {
+		formats = []string{danmuFormatASS}
+	}
+	if !hasHTML {
+		formats = append(formats, danmuFormatHTML)
+	}
+	return formats
+}
+
+// 获取下载弹幕时生成的所有文件
+func (s *streamer) danmuFiles(info liveInfo) (files []string) {
+	for _, format := range s.danmuFormats() {
+		files = append(files, info.danmuFile("."+format))
+	}
+	if s.DanmuArchive {
+		files = append(files, s.archiveFile(info))
+	}
+	return files
+}
+
+// 根据主播的设置新建弹幕输出，newFile为true时覆盖写入，弹幕文件只写入没有被filter过滤的弹幕，弹幕存档写入全部弹幕
+func (s *streamer) newDanmuWriters(info liveInfo, newFile bool, filter *danmuFilter) (writers []danmuWriter) {
+	if !s.Danmu {
+		return nil
+	}
+
+	fw := &filterWriter{filter: filter}
+	for _, format := range s.danmuFormats() {
+		var w danmuWriter
+		var err error
+		file := info.danmuFile("." + format)
+		switch format {
+		case danmuFormatASS:
+			w, err = newASSWriter(file, info, newFile)
+		case danmuFormatXML:
+			w, err = newXMLWriter(file, info, newFile)
+		case danmuFormatSRT:
+			w, err = newTextSubWriter(file, info, false, newFile)
+		case danmuFormatVTT:
+			w, err = newTextSubWriter(file, info, true, newFile)
+		case danmuFormatHTML:
+			w, err = newHTMLWriter(file, info, newFile)
+		default:
+			lPrintErrf("%s里%s的danmuFormat有未知的弹幕格式：%s", liveFile, s.longID(), format)
+			continue
+		}
+		if err != nil {
+			lPrintErrf("无法写入%s的%s弹幕文件：%v", s.longID(), format, err)
+		} else {
+			fw.writers = append(fw.writers, w)
+		}
+	}
+	if len(fw.writers) != 0 {
+		writers = append(writers, fw)
+	}
+
+	if s.DanmuArchive {
+		archive, err := newArchiveWriter(s.archiveFile(info), *s, info, s.DanmuArchiveGzip, newFile)
+		if err != nil {
+			lPrintErrf("无法写入%s的弹幕存档：%v", s.longID(), err)
+		} else {
+			writers = append(writers, archive)
+		}
+	}
+
+	return writers
+}
+
+// 等待录播实际开始的时间
+type recordStartWait struct {
+	ch       <-chan int64 // 录播实际开始的时间，是以纳秒为单位的Unix时间
+	deadline time.Time    // 超过该时间后不再等待
+}
+
+// 获取录播实际开始的时间，还需要等待时ok为false，超时后t为0
+func (w *recordStartWait) get() (t int64, ok bool) {
+	select {
+	case t = <-w.ch:
+		return t, true
+	default:
+	}
+	return 0, time.Now().After(w.deadline)
+}
+
+// 录播实际开始前缓存弹幕，开始后再新建需要和录播对齐的弹幕输出并写入缓存的弹幕
+type alignedWriter struct {
+	wait    *recordStartWait
+	create  func(startTime int64) []danmuWriter // startTime为0时表示没有获取到录播实际开始的时间
+	ready   bool
+	pending []acfundanmu.DanmuMessage
+	writers []danmuWriter
+}
+
+// 录播已经开始或者force为true时新建弹幕输出，返回是否已经新建
+func (w *alignedWriter) start(force bool) bool {
+	if w.ready {
+		return true
+	}
+	t, ok := w.wait.get()
+	if !ok && !force {
+		return false
+	}
+	w.ready = true
+	w.writers = w.create(t)
+	for _, d := range w.pending {
+		for _, writer := range w.writers {
+			_ = writer.writeDanmu(d)
+		}
+	}
+	w.pending = nil
+	return true
+}
+
+// 写入一条弹幕，录播开始前先缓存
+func (w *alignedWriter) writeDanmu(d acfundanmu.DanmuMessage) error {
+	if !w.start(false) {
+		w.pending = append(w.pending, d)
+		return nil
+	}
+	var err error
+	for _, writer := range w.writers {
+		if e := writer.writeDanmu(d); err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// 将缓存写入文件
+func (w *alignedWriter) flush() error {
+	if !w.start(false) {
+		return nil
+	}
+	var err error
+	for _, writer := range w.writers {
+		if e := writer.flush(); err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// 结束写入，还没有新建弹幕输出时不再等待
+func (w *alignedWriter) close() error {
+	w.start(true)
+	var err error
+	for _, writer := range w.writers {
+		if e := writer.close(); err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// 弹幕的来源，*acfundanmu.AcFunLive或者模拟AcFun服务器的弹幕
+type danmuSource interface {
+	// 获取弹幕，弹幕获取结束时返回nil
+	GetDanmu() []acfundanmu.DanmuMessage
+}
+
+// 从ac获取弹幕并写入到writers里，直到ctx结束或者弹幕获取结束，writers为空时只清空弹幕队列
+func (s *streamer) handleDanmu(ctx context.Context, ac danmuSource, writers []danmuWriter) {
+	defer func() {
+		for _, w := range writers {
+			if err := w.close(); err != nil {
+				lPrintErrf("结束写入%s的弹幕文件时出现错误：%v", s.longID(), err)
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+			danmu := ac.GetDanmu()
+			if danmu == nil {
+				return
+			}
+			for _, w := range writers {
+				for _, d := range danmu {
+					if err := w.writeDanmu(d); err != nil {
+						lPrintErrf("写入%s的弹幕时出现错误：%v", s.longID(), err)
+						break
+					}
+				}
+				if err := w.flush(); err != nil {
+					lPrintErrf("写入%s的弹幕时出现错误：%v", s.longID(), err)
+				}
+			}
+		}
+	}
+}
+
+// 连接主播的直播间，开始接收弹幕
+func (s *streamer) connectDanmu(ctx context.Context, cookies acfundanmu.Cookies) danmuSource {
+	if config.Endpoints.Mock {
+		return newMockDanmu(ctx, s.UID)
+	}
+	ac, err := acfundanmu.NewAcFunLive(acOptions(acfundanmu.SetLiverUID(int64(s.UID)), acfundanmu.SetCookies(cookies))...)
+	checkErr(err)
+	_ = ac.StartDanmu(ctx, false)
+	return ac
+}
+
+// 下载直播弹幕，recordStart不为nil时等待录播实际开始后再写入弹幕文件
+func (s streamer) getDanmu(ctx context.Context, info liveInfo, recordStart <-chan int64) {
 	defer func() {
 		if err := recover(); err != nil {
 			lPrintErr("Recovering from panic in getDanmu(), the error is:", err)
@@ -35,7 +290,7 @@ func (s streamer) getDanmu(ctx context.Context, info liveInfo) {
 			lPrintf("开始在%s的直播间挂机", s.longID())
 		} else {
 			lPrintErrf("没有登陆AcFun帐号，取消在%s的直播间挂机", s.longID())
-			if !s.Danmu {
+			if !s.Danmu && !s.GiftLedger && !s.Metrics && !s.Moderate {
 				return
 			}
 		}
@@ -43,7 +298,7 @@ func (s streamer) getDanmu(ctx context.Context, info liveInfo) {
 
 	if s.Danmu {
 		lPrintln("开始下载" + s.longID() + "的直播弹幕")
-		lPrintln("本次下载的ass文件保存在" + info.assFile)
+		lPrintln("本次下载的弹幕文件保存在" + strings.Join(s.danmuFiles(info), " "))
 		if *isListen {
 			lPrintf("如果想提前结束下载%s的直播弹幕，运行 stopdanmu %d", s.longID(), s.UID)
 		}
@@ -55,26 +310,119 @@ func (s streamer) getDanmu(ctx context.Context, info liveInfo) {
 		}
 	}
 
+	// 执行房管规则需要登陆AcFun帐号
+	if s.Moderate && !s.ModerateDryRun && !is_login_acfun() {
+		lPrintErrf("没有登陆AcFun帐号，取消在%s的直播间执行房管规则", s.longID())
+		s.Moderate = false
+		if !s.Danmu && !s.KeepOnline && !s.GiftLedger && !s.Metrics {
+			return
+		}
+	}
+
 	var cookies acfundanmu.Cookies
-	if s.KeepOnline {
+	if s.KeepOnline || s.Moderate {
 		cookies = acfun_cookies()
 	}
-	ac, err := acfundanmu.NewAcFunLive(acfundanmu.SetLiverUID(int64(s.UID)), acfundanmu.SetCookies(cookies))
-	checkErr(err)
-	_ = ac.StartDanmu(ctx, false)
+	ac := s.connectDanmu(ctx, cookies)
+	// 弹幕文件和精彩片段的时间线需要等待录播实际开始，其他输出不用等待
+	var wait *recordStartWait
+	if recordStart != nil && s.Danmu {
+		wait = &recordStartWait{ch: recordStart, deadline: time.Now().Add(recordStartTimeout)}
+	}
+	// 弹幕统计和弹幕提醒在弹幕下载重启时继续使用
+	var extra []danmuWriter
+	filter := s.newDanmuFilter()
 	if s.Danmu {
-		ac.WriteASS(ctx, info.cfg, info.assFile, true)
-		defer s.moveFile(info.assFile)
-	} else if s.KeepOnline {
-		for {
-			if danmu := ac.GetDanmu(); danmu == nil {
-				break
-			}
+		var moved []string
+		for _, file := range s.danmuFiles(info) {
+			defer s.moveFile(file)
+			moved = append(moved, s.movedFile(file))
 		}
-	} else {
-		lPrintErr("s.Danmu或s.KeepOnline必须为true")
+		historyAddFiles(info.LiveID, false, true, moved...)
+		jsonFile, mdFile := info.statsFiles()
+		defer s.moveFile(mdFile)
+		defer s.moveFile(jsonFile)
+		stats := newDanmuStats(s, info)
+		stats.filter = filter
+		defer stats.save()
+		extra = append(extra, stats)
+	} else if !s.KeepOnline && !s.GiftLedger && !s.Metrics && !s.Moderate {
+		lPrintErr("s.Danmu、s.KeepOnline、s.GiftLedger、s.Metrics或s.Moderate必须为true")
 		return
 	}
+	if s.GiftLedger {
+		lPrintf("开始将%s的直播礼物记录到礼物账本", s.longID())
+		extra = append(extra, newGiftLedger(s, info))
+	}
+	if watcher := newDanmuWatcher(s); watcher != nil {
+		extra = append(extra, watcher)
+	}
+	// 只有同时下载直播视频时才会剪辑精彩片段，录播结束后processRecord会取出时间线
+	var timeline *highlightTimeline
+	if s.Danmu && s.Highlight && recordStart != nil {
+		timeline = newHighlightTimeline(s, info)
+		timeline.store(strings.TrimSuffix(info.assFile, ".ass"))
+	}
+	// 观众数据在弹幕下载重启时继续使用
+	var metrics *metricsRecorder
+	if s.Metrics {
+		csvFile, jsonFile := info.metricsFiles()
+		defer s.moveFile(jsonFile)
+		defer s.moveFile(csvFile)
+		metrics = newMetricsRecorder(s, info)
+		defer metrics.save()
+		lPrintf("开始记录%s的直播间观众数据，保存在%s", s.longID(), csvFile)
+	}
+	var moderator *danmuModerator
+	if s.Moderate {
+		if moderator = newDanmuModerator(s, info); moderator != nil {
+			if s.ModerateDryRun {
+				lPrintf("开始在%s的直播间执行房管规则（dry run，只记录不踢人）", s.longID())
+			} else {
+				lPrintf("开始在%s的直播间执行房管规则", s.longID())
+			}
+			extra = append(extra, moderator)
+		}
+	}
+	// 需要和录播对齐的弹幕输出
+	alignedWriters := func(newFile bool) []danmuWriter {
+		writers := s.newDanmuWriters(info, newFile, filter)
+		if timeline != nil {
+			writers = append(writers, timeline)
+		}
+		return writers
+	}
+	handle := func(src danmuSource, newFile bool) {
+		// 模拟AcFun服务器的弹幕没有对应的AcFunLive
+		ac, _ := src.(*acfundanmu.AcFunLive)
+		if moderator != nil {
+			moderator.ac = ac
+		}
+		if metrics != nil && ac != nil {
+			mctx, mcancel := context.WithCancel(ctx)
+			defer mcancel()
+			go metrics.run(mctx, ac)
+		}
+		writers := extra
+		if wait != nil {
+			writers = append(writers, &alignedWriter{wait: wait, create: func(startTime int64) []danmuWriter {
+				if startTime != 0 {
+					info.cfg.StartTime = startTime
+				} else {
+					lPrintWarnf("没有获取到%s的直播视频实际开始的时间，弹幕的时间可能和录播对不上", s.longID())
+				}
+				if timeline != nil {
+					timeline.startTime = info.cfg.StartTime
+				}
+				wait = nil
+				return alignedWriters(newFile)
+			}})
+		} else {
+			writers = append(writers, alignedWriters(newFile)...)
+		}
+		s.handleDanmu(ctx, src, writers)
+	}
+	handle(ac, true)
 
 	time.Sleep(5 * time.Second)
 
@@ -89,18 +437,7 @@ Outer:
 			if s.isLiveOnByPage() {
 				if newLiveID := getLiveID(s.UID); newLiveID == info.LiveID {
 					lPrintWarn("因意外结束下载" + s.longID() + "的直播弹幕，尝试重启下载")
-					ac, err := acfundanmu.NewAcFunLive(acfundanmu.SetLiverUID(int64(s.UID)), acfundanmu.SetCookies(cookies))
-					checkErr(err)
-					_ = ac.StartDanmu(ctx, false)
-					if s.Danmu {
-						ac.WriteASS(ctx, info.cfg, info.assFile, false)
-					} else if s.KeepOnline {
-						for {
-							if danmu := ac.GetDanmu(); danmu == nil {
-								break
-							}
-						}
-					}
+					handle(s.connectDanmu(ctx, cookies), false)
 					time.Sleep(10 * time.Second)
 				} else {
 					break Outer
@@ -114,8 +451,20 @@ Outer:
 	if s.KeepOnline {
 		lPrintf("停止在%s的直播间挂机", s.longID())
 	}
+	if s.GiftLedger {
+		lPrintf("停止记录%s的直播礼物", s.longID())
+	}
+	if s.Metrics {
+		lPrintf("停止记录%s的直播间观众数据", s.longID())
+	}
+	if moderator != nil {
+		lPrintf("停止在%s的直播间执行房管规则", s.longID())
+	}
 	if s.Danmu {
 		lPrintln(s.longID() + "的直播弹幕下载已经结束")
+		if filter.dropped != 0 {
+			lPrintf("本次下载%s的直播弹幕时过滤了%d条弹幕", s.longID(), filter.dropped)
+		}
 		if s.Notify.NotifyDanmu {
 			if !s.Record {
 				desktopNotify(s.Name + "的直播弹幕下载已经结束")
@@ -136,30 +485,44 @@ func (s streamer) quitDanmu(liveID string) {
 		if s.KeepOnline {
 			info.isKeepOnline = false
 		}
+		if s.GiftLedger {
+			info.isGiftLedger = false
+		}
+		if s.Metrics {
+			info.isMetrics = false
+		}
+		if s.Moderate {
+			info.isModerate = false
+		}
 		lInfoMap.info[info.LiveID] = info
 	}
 }
 
 // 初始化弹幕下载
-func (s streamer) initDanmu(ctx context.Context, liveID, filename string) {
+// recordStart不为nil时弹幕的时间以录播实际开始的时间为准
+func (s streamer) initDanmu(ctx context.Context, liveID, filename string, recordStart <-chan int64) {
 	dctx, dcancel := context.WithCancel(ctx)
 	defer dcancel()
 	info, ok := getLiveInfo(liveID)
 	if ok {
-		if info.isDanmu && !info.isKeepOnline {
-			if s.Danmu && !s.KeepOnline {
-				lPrintWarnf("已经在下载%s的直播弹幕，如要重启下载，请先运行 stopdanmu %d", s.longID(), s.UID)
-				return
-			}
+		// 不重复下载弹幕、挂机、记录礼物和观众数据、执行房管规则
+		if info.isDanmu {
 			s.Danmu = false
-		} else if !info.isDanmu && info.isKeepOnline {
-			if !s.Danmu && s.KeepOnline {
-				lPrintWarn("已经在" + s.longID() + "的直播间挂机")
-				return
-			}
+		}
+		if info.isKeepOnline {
 			s.KeepOnline = false
-		} else if info.isDanmu && info.isKeepOnline {
-			lPrintWarnf("已经在下载%s的直播弹幕和在其直播间挂机，如要重启下载，请先运行 stopdanmu %d", s.longID(), s.UID)
+		}
+		if info.isGiftLedger {
+			s.GiftLedger = false
+		}
+		if info.isMetrics {
+			s.Metrics = false
+		}
+		if info.isModerate {
+			s.Moderate = false
+		}
+		if !s.Danmu && !s.KeepOnline && !s.GiftLedger && !s.Metrics && !s.Moderate {
+			lPrintWarnf("已经在下载%s的直播弹幕、在其直播间挂机、执行房管规则或记录其直播礼物和观众数据，如要重启下载，请先运行 stopdanmu %d", s.longID(), s.UID)
 			return
 		}
 	} else {
@@ -186,18 +549,29 @@ func (s streamer) initDanmu(ctx context.Context, liveID, filename string) {
 		info.isKeepOnline = true
 		info.onlineCancel = dcancel
 	}
+	if s.GiftLedger {
+		info.isGiftLedger = true
+	}
+	if s.Metrics {
+		info.isMetrics = true
+	}
+	if s.Moderate {
+		info.isModerate = true
+	}
 
 	assFile := transFilename(filename)
 	if assFile == "" {
 		return
 	}
 	info.assFile = assFile + ".ass"
+	info.style = s.ASSStyle
+	info.style.mergeTo(&info.cfg)
 	info.cfg.Title = filepath.Base(assFile)
 	info.cfg.StartTime = time.Now().UnixNano()
 	setLiveInfo(info)
 	defer s.quitDanmu(info.LiveID)
 
-	s.getDanmu(dctx, info)
+	s.getDanmu(dctx, info, recordStart)
 }
 
 // 临时下载指定主播的直播弹幕
@@ -229,10 +603,10 @@ func startDanmu(uid int) bool {
 	// 查看程序是否处于监听状态
 	if *isListen {
 		// goroutine是为了快速返回
-		go s.initDanmu(mainCtx, liveID, filename)
+		go s.initDanmu(mainCtx, liveID, filename, nil)
 	} else {
 		// 程序只在单独下载一个直播弹幕，不用goroutine，防止程序提前结束运行
-		s.initDanmu(mainCtx, liveID, filename)
+		s.initDanmu(mainCtx, liveID, filename, nil)
 	}
 	return true
 }
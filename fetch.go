@@ -4,6 +4,7 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"net/url"
 	"os"
 	"strings"
 	"sync"
@@ -44,6 +45,26 @@ var (
 	//fetchMedalInfoPool fastjson.ParserPool
 )
 
+// AcFun接口的地址，可以改为模拟AcFun服务器的地址
+type endpointData struct {
+	Live   string `json:"live"`   // 直播站的地址
+	Main   string `json:"main"`   // 主站的地址
+	Mobile string `json:"mobile"` // wap版网页的地址
+	Zt     string `json:"zt"`     // 快手中台接口的地址，用于发送弹幕
+	Mock   bool   `json:"mock"`   // 上面的地址是否是本程序的模拟AcFun服务器（-mockserver），是的话直播源和弹幕也从模拟服务器获取
+}
+
+// 检查AcFun接口的地址，去掉结尾的/
+func (e *endpointData) normalize() error {
+	for _, host := range []*string{&e.Live, &e.Main, &e.Mobile, &e.Zt} {
+		*host = strings.TrimRight(*host, "/")
+		if !strings.HasPrefix(*host, "http://") && !strings.HasPrefix(*host, "https://") {
+			return fmt.Errorf("地址 %s 必须以http://或https://开头", *host)
+		}
+	}
+	return nil
+}
+
 // 直播间的数据结构
 type liveRoom struct {
 	name   string // 主播名字
@@ -80,8 +101,8 @@ var medalInfoPool = &sync.Pool{
 
 // 获取主播的直播链接
 func getURL(uid int) string {
-	const livePage = "https://live.acfun.cn/live/%d"
-	return fmt.Sprintf(livePage, uid)
+	const livePage = "%s/live/%d"
+	return fmt.Sprintf(livePage, config.Endpoints.Live, uid)
 }
 
 // 获取主播的直播链接
@@ -151,8 +172,13 @@ func (c *httpClient) doRequest() (resp *fasthttp.Response, e error) {
 
 	req.Header.Set("Accept-Encoding", "gzip")
 
+	apiLimiter.wait()
 	err := c.client.Do(req, resp)
 	checkErr(err)
+	// 被限制请求时返回错误，调用者会退避后重试
+	if resp.StatusCode() == fasthttp.StatusTooManyRequests {
+		panic(fmt.Errorf("请求过于频繁，被限制请求"))
+	}
 
 	return resp, nil
 }
@@ -169,27 +195,49 @@ func getBody(resp *fasthttp.Response) []byte {
 	return resp.Body()
 }
 
-// 获取全部AcFun直播间
+// 获取直播间列表时最多请求的页数，防止pcursor出错时无限请求
+const maxRoomPages = 1000
+
+// 获取全部AcFun直播间，按pcursor分页获取，任意一页失败时保留上一次成功获取的直播间列表
 func fetchAllRooms() bool {
-	for count := 10000; count < 1e9; count *= 10 {
-		rooms, all, err := fetchLiveRoom(count)
+	rooms := make(map[int]*liveRoom)
+	pcursor := "0"
+	for page := 1; ; page++ {
+		if page > maxRoomPages {
+			lPrintErrf("获取正在直播的直播间列表失败：超过%d页", maxRoomPages)
+			releaseRooms(rooms)
+			return false
+		}
+		next, err := fetchLiveRoom(pcursor, config.RoomPageSize, rooms)
 		if err != nil {
-			lPrintErr(err)
+			lPrintErrf("获取第%d页直播间列表失败：%v", page, err)
+			releaseRooms(rooms)
 			return false
 		}
-		if all {
-			liveRooms.newRooms = rooms
-			return true
+		if next == "" || next == "no_more" {
+			break
 		}
-		if count == 1e8 {
-			lPrintErr("获取正在直播的直播间列表失败")
+		if next == pcursor {
+			lPrintErrf("获取正在直播的直播间列表失败：重复的pcursor %s", next)
+			releaseRooms(rooms)
+			return false
 		}
+		pcursor = next
 	}
-	return false
+	liveRooms.newRooms = rooms
+	return true
 }
 
-// 获取指定数量的AcFun直播间列表
-func fetchLiveRoom(count int) (rooms map[int]*liveRoom, all bool, e error) {
+// 将直播间放回pool
+func releaseRooms(rooms map[int]*liveRoom) {
+	for uid, room := range rooms {
+		delete(rooms, uid)
+		liveRoomPool.Put(room)
+	}
+}
+
+// 获取一页AcFun直播间列表，结果放进rooms，返回下一页的pcursor
+func fetchLiveRoom(pcursor string, count int, rooms map[int]*liveRoom) (next string, e error) {
 	defer func() {
 		if err := recover(); err != nil {
 			e = fmt.Errorf("fetchLiveRoom() error: %v", err)
@@ -197,10 +245,10 @@ func fetchLiveRoom(count int) (rooms map[int]*liveRoom, all bool, e error) {
 	}()
 
 	//const liveListURL = "https://live.acfun.cn/rest/pc-direct/live/channel"
-	const liveListURL = "https://live.acfun.cn/api/channel/list?count=%d&pcursor=0"
+	const liveListURL = "%s/api/channel/list?count=%d&pcursor=%s"
 
 	client := &httpClient{
-		url:    fmt.Sprintf(liveListURL, count),
+		url:    fmt.Sprintf(liveListURL, config.Endpoints.Live, count, url.QueryEscape(pcursor)),
 		method: fasthttp.MethodGet,
 	}
 	resp, err := client.doRequest()
@@ -208,6 +256,7 @@ func fetchLiveRoom(count int) (rooms map[int]*liveRoom, all bool, e error) {
 	defer fasthttp.ReleaseResponse(resp)
 	body := getBody(resp)
 
+	// 每一页解析完后就复用解析器，内存占用只和每页的数量有关
 	p := fetchRoomPool.Get()
 	defer fetchRoomPool.Put(p)
 	v, err := p.ParseBytes(body)
@@ -217,22 +266,20 @@ func fetchLiveRoom(count int) (rooms map[int]*liveRoom, all bool, e error) {
 		panic(fmt.Errorf("无法获取AcFun直播间列表，响应为：%s", string(body)))
 	}
 
-	if string(v.GetStringBytes("pcursor")) != "no_more" {
-		return nil, false, nil
-	}
-
-	liveList := v.GetArray("liveList")
-	rooms = make(map[int]*liveRoom, len(liveList))
-	for _, live := range liveList {
+	for _, live := range v.GetArray("liveList") {
 		uid := live.GetInt("authorId")
-		room := liveRoomPool.Get().(*liveRoom)
+		// 分页期间直播间列表可能变化，同一个主播只保留一个
+		room, ok := rooms[uid]
+		if !ok {
+			room = liveRoomPool.Get().(*liveRoom)
+			rooms[uid] = room
+		}
 		room.name = string(live.GetStringBytes("user", "name"))
 		room.title = string(live.GetStringBytes("title"))
 		room.liveID = string(live.GetStringBytes("liveId"))
-		rooms[uid] = room
 	}
 
-	return rooms, true, nil
+	return string(v.GetStringBytes("pcursor")), nil
 }
 
 // 根据uid获取主播的名字，可能需要检查返回是否为空
@@ -336,10 +383,10 @@ func fetchLiveInfo(uid int) (isLive bool, room *liveRoom, e error) {
 	//const acLiveInfo = "https://live.acfun.cn/rest/pc-direct/live/info"
 	//const acLiveInfo = "https://api-new.acfunchina.com/rest/app/live/info?authorId=%d"
 	//const acLiveInfo = "https://live.acfun.cn/rest/pc-direct/user/userInfo?userId=%d"
-	const acLiveInfo = "https://live.acfun.cn/api/live/info?authorId=%d"
+	const acLiveInfo = "%s/api/live/info?authorId=%d"
 
 	client := &httpClient{
-		url:    fmt.Sprintf(acLiveInfo, uid),
+		url:    fmt.Sprintf(acLiveInfo, config.Endpoints.Live, uid),
 		method: fasthttp.MethodGet,
 	}
 	resp, err := client.doRequest()
@@ -379,14 +426,14 @@ func fetchMedalList() (medalList []*medalInfo, e error) {
 		}
 	}()
 
-	const medalListURL = "https://www.acfun.cn/rest/pc-direct/fansClub/fans/medal/list"
+	const medalListURL = "%s/rest/pc-direct/fansClub/fans/medal/list"
 
 	if !is_login_acfun() {
 		return nil, fmt.Errorf("没有登陆AcFun帐号")
 	}
 
 	client := &httpClient{
-		url:     medalListURL,
+		url:     fmt.Sprintf(medalListURL, config.Endpoints.Main),
 		method:  fasthttp.MethodGet,
 		cookies: acfun_cookies(),
 	}
@@ -424,14 +471,14 @@ func fetchMedalInfo(uid int) (hasMedal bool, e error) {
 		}
 	}()
 
-	const medalInfoURL = "https://live.acfun.cn/rest/pc-direct/fansClub/fans/medal/detail?uperId=%d"
+	const medalInfoURL = "%s/rest/pc-direct/fansClub/fans/medal/detail?uperId=%d"
 
 	if len(acfunCookies) == 0 {
 		return false, fmt.Errorf("没有登陆AcFun帐号")
 	}
 
 	client := &httpClient{
-		url:     fmt.Sprintf(medalInfoURL, uid),
+		url:     fmt.Sprintf(medalInfoURL, config.Endpoints.Live, uid),
 		method:  fasthttp.MethodGet,
 		cookies: acfunCookies,
 	}
@@ -470,11 +517,11 @@ func (s *streamer) isLiveOnByPage() (isLive bool) {
 		}
 	}()
 
-	const acLivePage = "https://m.acfun.cn/live/detail/%d"
+	const acLivePage = "%s/live/detail/%d"
 	const mobileUserAgent = "Mozilla/5.0 (iPad; CPU iPhone OS 13_2_3 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/13.0.3 Mobile/15E148 Safari/604.1"
 
 	client := &httpClient{
-		url:       fmt.Sprintf(acLivePage, s.UID),
+		url:       fmt.Sprintf(acLivePage, config.Endpoints.Mobile, s.UID),
 		method:    fasthttp.MethodGet,
 		userAgent: mobileUserAgent,
 	}
@@ -490,6 +537,13 @@ func (s *streamer) isLiveOnByPage() (isLive bool) {
 
 // 获取AcFun的logo
 func fetchAcLogo() {
+	// 离线运行（比如连接模拟AcFun服务器）时下载失败不影响程序运行
+	defer func() {
+		if err := recover(); err != nil {
+			lPrintErrf("下载AcFun的logo失败：%v", err)
+		}
+	}()
+
 	const acLogo = "https://cdn.aixifan.com/ico/favicon.ico"
 
 	client := &httpClient{
@@ -517,14 +571,24 @@ func (s *streamer) getStreamInfo() (info streamInfo, e error) {
 		}
 	}()
 
-	var ac *acfundanmu.AcFunLive
+	var sInfo *acfundanmu.StreamInfo
 	var err error
 	err = runThrice(func() error {
-		ac, err = acfundanmu.NewAcFunLive(acfundanmu.SetLiverUID(int64(s.UID)))
+		// 模拟AcFun服务器直接提供直播源信息
+		if config.Endpoints.Mock {
+			sInfo, err = fetchMockStreamInfo(s.UID)
+			return err
+		}
+		ac, err := acfundanmu.NewAcFunLive(acOptions(acfundanmu.SetLiverUID(int64(s.UID)))...)
+		if err == nil {
+			sInfo = ac.GetStreamInfo()
+		}
 		return err
 	})
 	checkErr(err)
-	sInfo := ac.GetStreamInfo()
+	if len(sInfo.StreamList) == 0 {
+		panic(fmt.Errorf("%s没有直播源", s.longID()))
+	}
 	info.StreamInfo = *sInfo
 
 	index := 0
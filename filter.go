@@ -0,0 +1,207 @@
+// 弹幕过滤相关
+package main
+
+import (
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/orzogc/acfundanmu"
+)
+
+// 弹幕过滤的设置
+type filterData struct {
+	BlockUIDs     []int64  `json:"blockUIDs"`     // 过滤这些uid的用户的所有弹幕事件
+	BlockKeywords []string `json:"blockKeywords"` // 过滤包含这些关键词的弹幕
+	BlockRegexps  []string `json:"blockRegexps"`  // 过滤符合这些正则表达式的弹幕
+	DedupWindow   float64  `json:"dedupWindow"`   // 过滤在该秒数内重复出现的相同弹幕，为0时不过滤
+	MaxLength     int      `json:"maxLength"`     // 过滤字数超过该值的弹幕，为0时不过滤
+}
+
+// 将为null的列表设为空列表
+func (f *filterData) normalize() {
+	if f.BlockUIDs == nil {
+		f.BlockUIDs = []int64{}
+	}
+	if f.BlockKeywords == nil {
+		f.BlockKeywords = []string{}
+	}
+	if f.BlockRegexps == nil {
+		f.BlockRegexps = []string{}
+	}
+}
+
+// 过滤弹幕，弹幕下载重启时继续使用
+type danmuFilter struct {
+	blockUIDs   map[int64]bool
+	keywords    []string
+	regexps     []*regexp.Regexp
+	dedupWindow int64            // 以毫秒为单位
+	maxLength   int              // 弹幕的最多字数
+	lastSeen    map[string]int64 // 弹幕内容上一次没有被过滤的时间
+	lastClean   int64            // 上一次清理lastSeen里过期内容的时间
+	dropped     int              // 被过滤的弹幕数量
+}
+
+// 根据config.json和live.json的设置新建danmuFilter，live.json里的列表会加到config.json的列表上，dedupWindow和maxLength大于0时会覆盖config.json的设置
+func (s *streamer) newDanmuFilter() *danmuFilter {
+	g, p := config.Filter, s.Filter
+	f := &danmuFilter{
+		blockUIDs:   make(map[int64]bool),
+		dedupWindow: int64(g.DedupWindow * 1000),
+		maxLength:   g.MaxLength,
+		lastSeen:    make(map[string]int64),
+	}
+	if p.DedupWindow > 0 {
+		f.dedupWindow = int64(p.DedupWindow * 1000)
+	}
+	if p.MaxLength > 0 {
+		f.maxLength = p.MaxLength
+	}
+
+	for _, list := range [][]int64{g.BlockUIDs, p.BlockUIDs} {
+		for _, uid := range list {
+			f.blockUIDs[uid] = true
+		}
+	}
+	for _, list := range [][]string{g.BlockKeywords, p.BlockKeywords} {
+		for _, k := range list {
+			if k != "" {
+				f.keywords = append(f.keywords, strings.ToLower(k))
+			}
+		}
+	}
+	for _, list := range [][]string{g.BlockRegexps, p.BlockRegexps} {
+		for _, r := range list {
+			re, err := regexp.Compile(r)
+			if err != nil {
+				lPrintErrf("%s的filter有错误的正则表达式 %s ：%v", s.longID(), r, err)
+				continue
+			}
+			f.regexps = append(f.regexps, re)
+		}
+	}
+
+	return f
+}
+
+// 获取弹幕事件的用户uid，没有用户时返回0
+func danmuUserID(d acfundanmu.DanmuMessage) int64 {
+	switch d := d.(type) {
+	case *acfundanmu.Comment:
+		return d.UserID
+	case *acfundanmu.Like:
+		return d.UserID
+	case *acfundanmu.EnterRoom:
+		return d.UserID
+	case *acfundanmu.FollowAuthor:
+		return d.UserID
+	case *acfundanmu.ThrowBanana:
+		return d.UserID
+	case *acfundanmu.Gift:
+		return d.UserID
+	case *acfundanmu.JoinClub:
+		return d.FansInfo.UserID
+	case *acfundanmu.ShareLive:
+		return d.UserID
+	default:
+		return 0
+	}
+}
+
+// 弹幕是否需要被过滤，被过滤时增加计数
+func (f *danmuFilter) isBlocked(d acfundanmu.DanmuMessage) bool {
+	if f.check(d) {
+		f.dropped++
+		return true
+	}
+	return false
+}
+
+// 检查弹幕是否符合过滤规则
+func (f *danmuFilter) check(d acfundanmu.DanmuMessage) bool {
+	if uid := danmuUserID(d); uid != 0 && f.blockUIDs[uid] {
+		return true
+	}
+
+	c, ok := d.(*acfundanmu.Comment)
+	if !ok {
+		return false
+	}
+	if f.maxLength > 0 && utf8.RuneCountInString(c.Content) > f.maxLength {
+		return true
+	}
+	lower := strings.ToLower(c.Content)
+	for _, k := range f.keywords {
+		if strings.Contains(lower, k) {
+			return true
+		}
+	}
+	for _, re := range f.regexps {
+		if re.MatchString(c.Content) {
+			return true
+		}
+	}
+
+	if f.dedupWindow > 0 {
+		// 每个时间窗口最多清理一次过期的内容
+		if c.SendTime-f.lastClean >= f.dedupWindow {
+			for t, seen := range f.lastSeen {
+				if c.SendTime-seen >= f.dedupWindow {
+					delete(f.lastSeen, t)
+				}
+			}
+			f.lastClean = c.SendTime
+		}
+		// 只记录没有被过滤的弹幕，这样重复的弹幕每个时间窗口会保留一条
+		text := strings.TrimSpace(c.Content)
+		if last, ok := f.lastSeen[text]; ok && c.SendTime-last < f.dedupWindow {
+			return true
+		}
+		f.lastSeen[text] = c.SendTime
+	}
+
+	return false
+}
+
+// 过滤弹幕后再写入到writers里
+type filterWriter struct {
+	filter  *danmuFilter
+	writers []danmuWriter
+}
+
+// 写入一条没有被过滤的弹幕
+func (w *filterWriter) writeDanmu(d acfundanmu.DanmuMessage) error {
+	if w.filter.isBlocked(d) {
+		return nil
+	}
+	var err error
+	for _, writer := range w.writers {
+		if e := writer.writeDanmu(d); err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// 将所有writers的缓存写入文件
+func (w *filterWriter) flush() error {
+	var err error
+	for _, writer := range w.writers {
+		if e := writer.flush(); err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// 结束写入所有writers，filter在弹幕下载重启时继续使用
+func (w *filterWriter) close() error {
+	var err error
+	for _, writer := range w.writers {
+		if e := writer.close(); err == nil {
+			err = e
+		}
+	}
+	return err
+}
@@ -32,8 +32,37 @@ addrecord uid：自动下载指定主播的直播视频
 delrecord uid：取消自动下载指定主播的直播视频
 adddanmu uid：自动下载指定主播的直播弹幕
 deldanmu uid：取消自动下载指定主播的直播弹幕
+adddanmuarchive uid：下载指定主播的直播弹幕时将全部弹幕事件保存为jsonl存档
+deldanmuarchive uid：取消保存指定主播的弹幕存档
 addkeeponline uid：指定主播直播时在其直播间挂机
 delkeeponline uid：取消在指定主播直播时在其直播间挂机
+addburndanmu uid：下载指定主播的直播视频和弹幕结束后将弹幕压制到视频里
+delburndanmu uid：取消压制指定主播的直播弹幕
+addhighlight uid：下载指定主播的直播视频和弹幕结束后剪辑精彩片段
+delhighlight uid：取消剪辑指定主播的直播精彩片段
+addqualitycheck uid：下载指定主播的直播视频时检测黑屏、画面静止和无声
+delqualitycheck uid：取消检测指定主播的直播画面和声音
+adddanmustatsqq uid：指定主播的直播弹幕下载结束时将弹幕统计发送到QQ
+deldanmustatsqq uid：取消将指定主播的弹幕统计发送到QQ
+danmustats uid：查看指定主播最近一次直播的弹幕统计
+addgiftledger uid：将指定主播的直播收到的礼物记录到礼物账本
+delgiftledger uid：取消记录指定主播的直播礼物
+addmetrics uid：定时记录指定主播的直播间观众数据
+delmetrics uid：取消记录指定主播的直播间观众数据
+addmoderate uid：在指定主播的直播间自动执行房管规则
+delmoderate uid：取消在指定主播的直播间执行房管规则
+addmoderatedryrun uid：只记录房管规则将要进行的操作，不真正踢人
+delmoderatedryrun uid：房管规则真正踢人
+senddanmu uid 弹幕内容：用登陆的AcFun帐号发送弹幕到指定主播的直播间，弹幕内容可以包含空格
+moderatelog：查看最近的房管操作记录
+moderatelog uid：查看指定主播的直播间最近的房管操作记录
+history uid：查看指定主播最近的直播历史，包括开播和下播时间、标题和下载的文件
+history uid 开始日期 结束日期：查看指定主播在日期范围内开播的直播历史，日期格式为2006-01-02，可以只设置开始日期
+schedule uid：查看根据直播历史统计的指定主播的直播时间表，包括每周各天和各小时在直播的概率、平均直播时长和通常开播的时间
+giftsession：按直播汇总礼物账本里所有主播收到的礼物
+giftsession uid：按直播汇总礼物账本里指定主播收到的礼物
+giftday：按天汇总礼物账本里所有主播收到的礼物
+giftday uid：按天汇总礼物账本里指定主播收到的礼物
 delconfig uid：删除指定主播的所有设置
 getdlurl uid：查看指定主播是否在直播，如在直播输出其直播源地址
 addqq uid QQ号：设置将指定主播的开播提醒发送到指定QQ号，需要QQ机器人已经添加该QQ为好友
@@ -48,6 +77,8 @@ startdanmu uid：临时下载指定主播的直播弹幕，如果没有设置自
 stopdanmu uid：正在下载指定主播的直播弹幕时取消下载
 startrecdan uid：临时下载指定主播的直播视频和弹幕），如果没有设置自动下载该主播的直播视频和弹幕，这次为一次性的下载
 stoprecdan uid：正在下载指定主播的直播视频和弹幕时取消下载
+watchdanmu uid：在终端查看指定主播的直播弹幕、礼物和进入直播间，不写入任何文件
+stopwatchdanmu uid：停止在终端查看指定主播的直播弹幕
 quit：退出本程序，退出需要等待半分钟左右
 help：输出本帮助信息`
 
@@ -60,14 +91,16 @@ var boolDispatch = map[string]func() bool{
 }
 
 var uidBoolDispatch = map[string]func(int) bool{
-	"delconfig":     deleteStreamer,
-	"stoprecord":    stopRec,
-	"startdanmu":    startDanmu,
-	"stopdanmu":     stopDanmu,
-	"startrecdan":   startRecDan,
-	"stoprecdan":    stopRecDan,
-	"cancelqq":      cancelQQNotify,
-	"cancelqqgroup": cancelQQGroup,
+	"delconfig":      deleteStreamer,
+	"stoprecord":     stopRec,
+	"startdanmu":     startDanmu,
+	"stopdanmu":      stopDanmu,
+	"startrecdan":    startRecDan,
+	"stoprecdan":     stopRecDan,
+	"watchdanmu":     watchDanmu,
+	"stopwatchdanmu": stopWatchDanmu,
+	"cancelqq":       cancelQQNotify,
+	"cancelqqgroup":  cancelQQGroup,
 }
 
 var listDispatch = map[string]func() []streaming{
@@ -100,6 +133,12 @@ func handleCmd(cmd string) string {
 		data, err := json.MarshalIndent(getStreamers(), "", "    ")
 		checkErr(err)
 		return string(data)
+	case "giftsession":
+		return giftLedgerJSON("session", 0)
+	case "giftday":
+		return giftLedgerJSON("day", 0)
+	case "moderatelog":
+		return moderationLogJSON(0)
 	case "quit":
 		quitRun()
 		return "true"
@@ -149,6 +188,25 @@ func handleCmdUID(cmd string, uid int) string {
 	switch cmd {
 	case "startrecord":
 		return boolStr(startRec(uid, false))
+	case "danmustats":
+		r, ok := getDanmuReport(uid)
+		if !ok {
+			lPrintWarnf("没有%s最近一次直播的弹幕统计", longID(uid))
+			return ""
+		}
+		data, err := json.MarshalIndent(r, "", "    ")
+		checkErr(err)
+		return string(data)
+	case "giftsession":
+		return giftLedgerJSON("session", uid)
+	case "giftday":
+		return giftLedgerJSON("day", uid)
+	case "moderatelog":
+		return moderationLogJSON(uid)
+	case "history":
+		return historyJSON(uid, "", "")
+	case "schedule":
+		return scheduleJSON(uid)
 	case "getdlurl":
 		hlsURL, flvURL := printStreamURL(uid)
 		data, err := json.MarshalIndent([]string{hlsURL, flvURL}, "", "    ")
@@ -180,6 +238,31 @@ func printErr() {
 // 处理所有命令
 func handleAllCmd(text string) string {
 	cmd := strings.Fields(text)
+	// senddanmu的弹幕内容可以包含空格
+	if len(cmd) >= 3 && cmd[0] == "senddanmu" {
+		uid, err := strconv.ParseUint(cmd[1], 10, 64)
+		if err != nil {
+			printErr()
+			return ""
+		}
+		content := text[strings.Index(text, cmd[1])+len(cmd[1]):]
+		return sendDanmu(int(uid), content)
+	}
+	// history的日期范围
+	if len(cmd) == 3 || len(cmd) == 4 {
+		if cmd[0] == "history" {
+			uid, err := strconv.ParseUint(cmd[1], 10, 64)
+			if err != nil {
+				printErr()
+				return ""
+			}
+			to := ""
+			if len(cmd) == 4 {
+				to = cmd[3]
+			}
+			return historyJSON(int(uid), cmd[2], to)
+		}
+	}
 	switch len(cmd) {
 	case 1:
 		switch cmd[0] {
@@ -0,0 +1,387 @@
+// 精彩片段剪辑相关
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/orzogc/acfundanmu"
+)
+
+// 每个精彩片段列出的代表性弹幕的最多数量
+const highlightTopComments = 3
+
+// 时间线每秒最多记录的不同弹幕内容的数量，超过时新出现的内容不再记录
+const highlightSecondContents = 8
+
+// 精彩片段剪辑的设置
+type highlightData struct {
+	Clips      int     `json:"clips"`      // 最多剪辑的片段数量
+	Window     float64 `json:"window"`     // 计算弹幕密度的时间窗口秒数，也是片段不算前后留白的长度
+	Padding    float64 `json:"padding"`    // 片段前后各留白的秒数
+	GiftWeight float64 `json:"giftWeight"` // 一个礼物相当于多少条弹幕，为0时只看弹幕密度
+}
+
+// 一个精彩片段
+type highlightClip struct {
+	File        string   `json:"file"`        // 片段的文件名
+	Start       float64  `json:"start"`       // 相对于录播开始的秒数
+	End         float64  `json:"end"`         // 相对于录播开始的秒数
+	StartText   string   `json:"startText"`   // 开始时间，格式为时:分:秒
+	Comments    int      `json:"comments"`    // 时间窗口里的弹幕数量
+	Gifts       int      `json:"gifts"`       // 时间窗口里的礼物数量
+	TopComments []string `json:"topComments"` // 时间窗口里出现最多的弹幕
+}
+
+// 精彩片段的索引文件
+type highlightIndex struct {
+	UID        int             `json:"uid"`        // 主播uid
+	Name       string          `json:"name"`       // 主播名字
+	LiveID     string          `json:"liveID"`     // 直播ID
+	RecordFile string          `json:"recordFile"` // 录播文件名
+	Clips      []highlightClip `json:"clips"`      // 按时间排序的精彩片段
+}
+
+// 记录每秒弹幕和礼物数量的时间线，实现danmuWriter，弹幕下载重启时继续记录
+type highlightTimeline struct {
+	uid       int
+	name      string
+	liveID    string
+	startTime int64            // 以纳秒为单位的Unix时间，和录播开始的时间对齐
+	comments  []int            // 每秒的弹幕数量
+	gifts     []int            // 每秒的礼物数量
+	contents  []map[string]int // 每秒各种弹幕内容的数量，只记录有限的几种
+}
+
+// 录播结束后等待剪辑的时间线，key为去掉后缀名的弹幕文件路径
+var highlightTimelines struct {
+	sync.Mutex
+	timeline map[string]*highlightTimeline
+}
+
+// 新建highlightTimeline
+func newHighlightTimeline(s streamer, info liveInfo) *highlightTimeline {
+	return &highlightTimeline{
+		uid:       s.UID,
+		name:      s.Name,
+		liveID:    info.LiveID,
+		startTime: info.cfg.StartTime,
+	}
+}
+
+// 获取相对于录播开始的秒数，录播开始前的弹幕返回-1
+func (t *highlightTimeline) second(sendTime int64) int {
+	d := sendTime*1e6 - t.startTime
+	if d < 0 {
+		return -1
+	}
+	return int(d / int64(time.Second))
+}
+
+// 记录一条弹幕或礼物
+func (t *highlightTimeline) writeDanmu(d acfundanmu.DanmuMessage) error {
+	switch d := d.(type) {
+	case *acfundanmu.Comment:
+		sec := t.second(d.SendTime)
+		if sec < 0 {
+			return nil
+		}
+		for len(t.comments) <= sec {
+			t.comments = append(t.comments, 0)
+		}
+		t.comments[sec]++
+		for len(t.contents) <= sec {
+			t.contents = append(t.contents, nil)
+		}
+		if t.contents[sec] == nil {
+			t.contents[sec] = make(map[string]int)
+		}
+		if _, ok := t.contents[sec][d.Content]; ok || len(t.contents[sec]) < highlightSecondContents {
+			t.contents[sec][d.Content]++
+		}
+	case *acfundanmu.Gift, *acfundanmu.ThrowBanana:
+		sec := t.second(d.GetSendTime())
+		if sec < 0 {
+			return nil
+		}
+		for len(t.gifts) <= sec {
+			t.gifts = append(t.gifts, 0)
+		}
+		t.gifts[sec]++
+	}
+	return nil
+}
+
+// 时间线不需要flush
+func (t *highlightTimeline) flush() error {
+	return nil
+}
+
+// 弹幕下载重启时继续记录，所以不做任何事情
+func (t *highlightTimeline) close() error {
+	return nil
+}
+
+// 保存时间线，录播结束后等待弹幕下载结束再剪辑
+func (t *highlightTimeline) store(key string) {
+	highlightTimelines.Lock()
+	defer highlightTimelines.Unlock()
+	highlightTimelines.timeline[key] = t
+}
+
+// 取出保存的时间线
+func loadHighlightTimeline(key string) *highlightTimeline {
+	highlightTimelines.Lock()
+	defer highlightTimelines.Unlock()
+	t := highlightTimelines.timeline[key]
+	delete(highlightTimelines.timeline, key)
+	return t
+}
+
+// 获取秒数对应的数量
+func countAt(counts []int, sec int) int {
+	if sec < len(counts) {
+		return counts[sec]
+	}
+	return 0
+}
+
+// 找出弹幕和礼物密度最高的片段，按时间排序
+func (t *highlightTimeline) highlights(cfg highlightData) []highlightClip {
+	length := len(t.comments)
+	if len(t.gifts) > length {
+		length = len(t.gifts)
+	}
+	window := int(cfg.Window)
+	if window < 1 {
+		window = 1
+	}
+	padding := int(cfg.Padding)
+
+	// 以每一秒开始的时间窗口的分数
+	type candidate struct {
+		start    int
+		comments int
+		gifts    int
+		score    float64
+	}
+	candidates := make([]candidate, 0, length)
+	var comments, gifts int
+	for i := 0; i < length; i++ {
+		comments += countAt(t.comments, i)
+		gifts += countAt(t.gifts, i)
+		if i >= window {
+			comments -= countAt(t.comments, i-window)
+			gifts -= countAt(t.gifts, i-window)
+		}
+		if start := i - window + 1; start >= 0 || i == length-1 {
+			if start < 0 {
+				start = 0
+			}
+			c := candidate{start: start, comments: comments, gifts: gifts}
+			c.score = float64(comments) + float64(gifts)*cfg.GiftWeight
+			if c.score > 0 {
+				candidates = append(candidates, c)
+			}
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].score > candidates[j].score
+	})
+
+	// 选出互不重叠的片段
+	var chosen []candidate
+	for _, c := range candidates {
+		if len(chosen) >= cfg.Clips {
+			break
+		}
+		overlap := false
+		for _, o := range chosen {
+			if c.start < o.start+window+2*padding && o.start < c.start+window+2*padding {
+				overlap = true
+				break
+			}
+		}
+		if !overlap {
+			chosen = append(chosen, c)
+		}
+	}
+	sort.Slice(chosen, func(i, j int) bool {
+		return chosen[i].start < chosen[j].start
+	})
+
+	clips := make([]highlightClip, 0, len(chosen))
+	for _, c := range chosen {
+		start := c.start - padding
+		if start < 0 {
+			start = 0
+		}
+		clips = append(clips, highlightClip{
+			Start:       float64(start),
+			End:         float64(c.start + window + padding),
+			StartText:   formatSeconds(start),
+			Comments:    c.comments,
+			Gifts:       c.gifts,
+			TopComments: t.topComments(c.start, c.start+window),
+		})
+	}
+	return clips
+}
+
+// 获取[start, end)秒内出现最多的弹幕
+func (t *highlightTimeline) topComments(start, end int) []string {
+	count := make(map[string]int)
+	var order []string
+	for sec := start; sec < end && sec < len(t.contents); sec++ {
+		if sec < 0 {
+			continue
+		}
+		for content, n := range t.contents[sec] {
+			if count[content] == 0 {
+				order = append(order, content)
+			}
+			count[content] += n
+		}
+	}
+	sort.Slice(order, func(i, j int) bool {
+		if count[order[i]] != count[order[j]] {
+			return count[order[i]] > count[order[j]]
+		}
+		return order[i] < order[j]
+	})
+	if len(order) > highlightTopComments {
+		order = order[:highlightTopComments]
+	}
+	if order == nil {
+		order = []string{}
+	}
+	return order
+}
+
+// 将秒数转换为时:分:秒
+func formatSeconds(sec int) string {
+	return fmt.Sprintf("%02d:%02d:%02d", sec/3600, sec/60%60, sec%60)
+}
+
+// 根据时间线从录播文件无损剪辑精彩片段并生成索引文件，返回生成的文件
+func cutHighlights(recordFile string, t *highlightTimeline) (files []string, e error) {
+	defer func() {
+		if err := recover(); err != nil {
+			e = fmt.Errorf("cutHighlights() error: %v", err)
+		}
+	}()
+
+	ffmpegFile := getFFmpeg()
+	if ffmpegFile == "" {
+		return nil, fmt.Errorf("没有找到FFmpeg")
+	}
+	if info, err := os.Stat(recordFile); err != nil || info.Size() == 0 {
+		return nil, fmt.Errorf("录播文件 %s 不存在或为空", recordFile)
+	}
+
+	clips := t.highlights(config.Highlight)
+	if len(clips) == 0 {
+		return nil, fmt.Errorf("录播文件 %s 对应的弹幕里没有弹幕或礼物", recordFile)
+	}
+
+	ext := filepath.Ext(recordFile)
+	base := strings.TrimSuffix(recordFile, ext)
+	for i := range clips {
+		clip := &clips[i]
+		outFile := fmt.Sprintf("%s.clip%02d%s", base, i+1, ext)
+		clip.File = filepath.Base(outFile)
+		// 不重新编码，片段会从开始时间前最近的关键帧开始
+		cmd := exec.Command(ffmpegFile, "-hide_banner", "-nostdin", "-y",
+			"-ss", strconv.FormatFloat(clip.Start, 'f', -1, 64),
+			"-i", recordFile,
+			"-t", strconv.FormatFloat(clip.End-clip.Start, 'f', -1, 64),
+			"-map", "0", "-c", "copy", "-avoid_negative_ts", "make_zero",
+			outFile)
+		hideCmdWindow(cmd)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			_ = os.Remove(outFile)
+			return files, fmt.Errorf("剪辑片段 %s 失败：%v，ffmpeg的输出：%s", outFile, err, lastLines(string(out), 5))
+		}
+		files = append(files, outFile)
+	}
+
+	index := highlightIndex{
+		UID:        t.uid,
+		Name:       t.name,
+		LiveID:     t.liveID,
+		RecordFile: filepath.Base(recordFile),
+		Clips:      clips,
+	}
+	indexFile := base + ".highlights.json"
+	data, err := json.MarshalIndent(index, "", "    ")
+	checkErr(err)
+	err = os.WriteFile(indexFile, data, 0644)
+	checkErr(err)
+	files = append(files, indexFile)
+
+	return files, nil
+}
+
+// 剪辑录播文件的精彩片段，剪辑后移动生成的文件
+func (s streamer) clipHighlights(recordFile string) {
+	base := strings.TrimSuffix(recordFile, filepath.Ext(recordFile))
+	t := loadHighlightTimeline(base)
+	if t == nil {
+		lPrintErrf("没有找到录播文件 %s 对应的弹幕，取消剪辑精彩片段", recordFile)
+		return
+	}
+
+	lPrintln("开始剪辑" + s.longID() + "的直播精彩片段")
+	files, err := cutHighlights(recordFile, t)
+	for _, file := range files {
+		defer s.moveFile(file)
+	}
+	if err != nil {
+		lPrintErrf("剪辑%s的直播精彩片段失败：%v", s.longID(), err)
+		return
+	}
+	lPrintf("%s的直播精彩片段剪辑完成，共%d个片段，索引文件为%s", s.longID(), len(files)-1, files[len(files)-1])
+	if s.Notify.NotifyRecord {
+		desktopNotify(s.Name + "的直播精彩片段剪辑完成")
+		s.sendMirai(fmt.Sprintf("%s的直播精彩片段剪辑完成，共%d个片段", s.Name, len(files)-1), false)
+	}
+}
+
+// 根据弹幕存档剪辑录播文件的精彩片段，不需要连接AcFun
+func highlightArchive(archiveFile, recordFile string) error {
+	var t *highlightTimeline
+	err := readArchive(archiveFile, func(header *archiveHeaderData, d acfundanmu.DanmuMessage) error {
+		if t == nil {
+			// 没有直播信息时以第一条弹幕的时间作为开始时间
+			t = &highlightTimeline{startTime: d.GetSendTime() * 1e6}
+			if header != nil {
+				t.uid = header.UID
+				t.name = header.Name
+				t.liveID = header.LiveID
+				t.startTime = header.StartTime * 1e6
+			}
+		}
+		return t.writeDanmu(d)
+	})
+	if err != nil {
+		return err
+	}
+	if t == nil {
+		return fmt.Errorf("弹幕存档 %s 里没有弹幕", archiveFile)
+	}
+
+	files, err := cutHighlights(recordFile, t)
+	if err != nil {
+		return err
+	}
+	lPrintf("成功剪辑%d个精彩片段，索引文件为%s", len(files)-1, files[len(files)-1])
+	return nil
+}
@@ -0,0 +1,450 @@
+// 直播历史记录相关
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// 直播历史记录数据库文件名字
+const historyFile = "history.db"
+
+// 查看直播历史记录时最多返回的数量
+const historyLimit = 100
+
+// 更新正在直播的直播最后一次被看到的时间的最小间隔
+const historyTouchInterval = time.Minute
+
+// 直播历史记录数据库文件位置
+var historyFileLocation string
+
+// 数据库里的bucket
+var (
+	historySessions = []byte("sessions") // key为liveID，value为liveSession的JSON
+	historyIndex    = []byte("uidIndex") // key为uid+开播时间+liveID，用来按主播和时间查找
+	historyOpen     = []byte("open")     // key为还没有下播的直播的liveID
+)
+
+// 直播历史记录数据库，打开失败时为nil
+var historyDB struct {
+	sync.Mutex
+	db        *bolt.DB
+	lastTouch time.Time // 上一次更新lastSeen的时间
+}
+
+// 一场直播的历史记录
+type liveSession struct {
+	UID       int      `json:"uid"`       // 主播uid
+	Name      string   `json:"name"`      // 主播名字
+	LiveID    string   `json:"liveID"`    // 直播ID
+	Titles    []string `json:"titles"`    // 直播期间使用过的直播间标题，按时间排序
+	StartTime int64    `json:"startTime"` // 发现开播的时间，是以毫秒为单位的Unix时间
+	EndTime   int64    `json:"endTime"`   // 发现下播的时间，是以毫秒为单位的Unix时间，还在直播时为0
+	LastSeen  int64    `json:"lastSeen"`  // 最后一次发现在直播的时间，是以毫秒为单位的Unix时间
+	Duration  float64  `json:"duration"`  // 直播的秒数，还在直播时是到现在的秒数
+	Recorded  bool     `json:"recorded"`  // 是否下载了直播视频
+	Danmu     bool     `json:"danmu"`     // 是否下载了直播弹幕
+	Files     []string `json:"files"`     // 下载的文件，是移动后的路径
+}
+
+// 生成索引的key
+func historyIndexKey(uid int, startTime int64, liveID string) []byte {
+	key := make([]byte, 16, 16+len(liveID))
+	binary.BigEndian.PutUint64(key, uint64(uid))
+	binary.BigEndian.PutUint64(key[8:], uint64(startTime))
+	return append(key, liveID...)
+}
+
+// 打开直播历史记录数据库，结束上一次运行时没有记录下播的直播
+func openHistory() {
+	db, err := bolt.Open(historyFileLocation, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		lPrintErrf("打开直播历史记录数据库 %s 失败，不会记录直播历史：%v", historyFileLocation, err)
+		return
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{historySessions, historyIndex, historyOpen} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		lPrintErrf("初始化直播历史记录数据库失败，不会记录直播历史：%v", err)
+		_ = db.Close()
+		return
+	}
+
+	historyDB.Lock()
+	historyDB.db = db
+	historyDB.Unlock()
+
+	// 现在不在直播的直播以最后一次发现在直播的时间作为下播时间
+	live := liveIDs()
+	err = updateHistory(func(tx *bolt.Tx) error {
+		c := tx.Bucket(historyOpen).Cursor()
+		var closed []string
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			if !live[string(k)] {
+				closed = append(closed, string(k))
+			}
+		}
+		for _, liveID := range closed {
+			if err := updateSession(tx, liveID, func(s *liveSession) {
+				s.EndTime = s.LastSeen
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		lPrintErrf("更新直播历史记录失败：%v", err)
+	}
+}
+
+// 获取直播间列表里正在直播的liveID
+func liveIDs() map[string]bool {
+	liveRooms.RLock()
+	defer liveRooms.RUnlock()
+	live := make(map[string]bool, len(liveRooms.rooms))
+	for _, room := range liveRooms.rooms {
+		live[room.liveID] = true
+	}
+	return live
+}
+
+// 关闭直播历史记录数据库
+func closeHistory() {
+	historyDB.Lock()
+	defer historyDB.Unlock()
+	if historyDB.db != nil {
+		if err := historyDB.db.Close(); err != nil {
+			lPrintErrf("关闭直播历史记录数据库失败：%v", err)
+		}
+		historyDB.db = nil
+	}
+}
+
+// 修改直播历史记录数据库，数据库没有打开时不做任何事情
+func updateHistory(f func(tx *bolt.Tx) error) error {
+	historyDB.Lock()
+	defer historyDB.Unlock()
+	if historyDB.db == nil {
+		return nil
+	}
+	return historyDB.db.Update(f)
+}
+
+// 读取一场直播的历史记录，不存在时返回nil
+func getSession(tx *bolt.Tx, liveID string) (*liveSession, error) {
+	data := tx.Bucket(historySessions).Get([]byte(liveID))
+	if data == nil {
+		return nil, nil
+	}
+	s := new(liveSession)
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("直播%s的历史记录格式错误：%w", liveID, err)
+	}
+	return s, nil
+}
+
+// 保存一场直播的历史记录
+func putSession(tx *bolt.Tx, s *liveSession) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	if err := tx.Bucket(historySessions).Put([]byte(s.LiveID), data); err != nil {
+		return err
+	}
+	if err := tx.Bucket(historyIndex).Put(historyIndexKey(s.UID, s.StartTime, s.LiveID), nil); err != nil {
+		return err
+	}
+	if s.EndTime == 0 {
+		return tx.Bucket(historyOpen).Put([]byte(s.LiveID), nil)
+	}
+	return tx.Bucket(historyOpen).Delete([]byte(s.LiveID))
+}
+
+// 修改已经存在的直播历史记录
+func updateSession(tx *bolt.Tx, liveID string, f func(s *liveSession)) error {
+	s, err := getSession(tx, liveID)
+	if err != nil || s == nil {
+		return err
+	}
+	f(s)
+	return putSession(tx, s)
+}
+
+// 添加直播间标题，和最后一个标题相同时不添加
+func (s *liveSession) addTitle(title string) {
+	if title != "" && (len(s.Titles) == 0 || s.Titles[len(s.Titles)-1] != title) {
+		s.Titles = append(s.Titles, title)
+	}
+}
+
+// 记录开播，直播已经有记录时只更新标题
+func historyLiveOn(uid int, name, liveID, title string) {
+	if liveID == "" {
+		return
+	}
+	now := time.Now().UnixMilli()
+	err := updateHistory(func(tx *bolt.Tx) error {
+		s, err := getSession(tx, liveID)
+		if err != nil {
+			return err
+		}
+		if s == nil {
+			s = &liveSession{UID: uid, Name: name, LiveID: liveID, StartTime: now, Titles: []string{}, Files: []string{}}
+		}
+		// liveID改变时不会有下播事件，结束该主播之前还没有下播的直播
+		if err := closeOtherSessions(tx, uid, liveID); err != nil {
+			return err
+		}
+		// 程序重启后同一场直播继续记录
+		s.EndTime = 0
+		s.LastSeen = now
+		s.addTitle(title)
+		return putSession(tx, s)
+	})
+	if err != nil {
+		lPrintErrf("记录%s的直播历史失败：%v", longID(uid), err)
+	}
+}
+
+// 以最后一次发现在直播的时间作为下播时间，结束指定主播除了liveID以外还没有下播的直播
+func closeOtherSessions(tx *bolt.Tx, uid int, liveID string) error {
+	c := tx.Bucket(historyOpen).Cursor()
+	var open []string
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		if string(k) != liveID {
+			open = append(open, string(k))
+		}
+	}
+	for _, id := range open {
+		s, err := getSession(tx, id)
+		if err != nil {
+			return err
+		}
+		if s != nil && s.UID == uid {
+			s.EndTime = s.LastSeen
+			if err := putSession(tx, s); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// 记录修改直播间标题
+func historyTitle(liveID, title string) {
+	err := updateHistory(func(tx *bolt.Tx) error {
+		return updateSession(tx, liveID, func(s *liveSession) {
+			s.addTitle(title)
+			s.LastSeen = time.Now().UnixMilli()
+		})
+	})
+	if err != nil {
+		lPrintErrf("记录直播%s的标题失败：%v", liveID, err)
+	}
+}
+
+// 记录下播
+func historyLiveOff(liveID string) {
+	err := updateHistory(func(tx *bolt.Tx) error {
+		return updateSession(tx, liveID, func(s *liveSession) {
+			s.EndTime = time.Now().UnixMilli()
+			s.LastSeen = s.EndTime
+		})
+	})
+	if err != nil {
+		lPrintErrf("记录直播%s的下播失败：%v", liveID, err)
+	}
+}
+
+// 记录下载的文件
+func historyAddFiles(liveID string, recorded, danmu bool, files ...string) {
+	err := updateHistory(func(tx *bolt.Tx) error {
+		return updateSession(tx, liveID, func(s *liveSession) {
+			s.Recorded = s.Recorded || recorded
+			s.Danmu = s.Danmu || danmu
+			for _, file := range files {
+				if abs, err := filepath.Abs(file); err == nil {
+					file = abs
+				}
+				s.Files = append(s.Files, file)
+			}
+		})
+	})
+	if err != nil {
+		lPrintErrf("记录直播%s下载的文件失败：%v", liveID, err)
+	}
+}
+
+// 根据直播间列表的变化记录设置里的主播的直播历史
+func recordHistory(events map[int]liveEvent) {
+	sInfoMap.Lock()
+	uids := make([]int, 0, len(events))
+	for uid := range events {
+		if _, ok := sInfoMap.info[uid]; ok {
+			uids = append(uids, uid)
+		}
+	}
+	sInfoMap.Unlock()
+
+	for _, uid := range uids {
+		e := events[uid]
+		switch e.t {
+		case liveOn:
+			historyLiveOn(uid, e.name, e.liveID, e.title)
+		case liveOff:
+			historyLiveOff(e.liveID)
+		case titleChanged:
+			historyTitle(e.liveID, e.title)
+		}
+	}
+	touchHistory()
+}
+
+// 定时更新正在直播的直播最后一次被看到的时间，已经不在直播间列表里的直播（比如主播被移出live.json）以最后一次发现在直播的时间作为下播时间
+func touchHistory() {
+	historyDB.Lock()
+	if time.Since(historyDB.lastTouch) < historyTouchInterval {
+		historyDB.Unlock()
+		return
+	}
+	historyDB.lastTouch = time.Now()
+	historyDB.Unlock()
+
+	live := liveIDs()
+	now := time.Now().UnixMilli()
+	err := updateHistory(func(tx *bolt.Tx) error {
+		c := tx.Bucket(historyOpen).Cursor()
+		var open []string
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			open = append(open, string(k))
+		}
+		for _, liveID := range open {
+			if err := updateSession(tx, liveID, func(s *liveSession) {
+				if live[liveID] {
+					s.LastSeen = now
+				} else {
+					s.EndTime = s.LastSeen
+				}
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		lPrintErrf("更新直播历史记录失败：%v", err)
+	}
+}
+
+// 记录设置里正在直播的主播，用于程序启动时
+func historyStartup() {
+	for _, s := range getStreamers() {
+		if liveID := getLiveID(s.UID); liveID != "" {
+			historyLiveOn(s.UID, s.Name, liveID, getTitle(s.UID))
+		}
+	}
+}
+
+// 解析日期，格式为2006-01-02
+func parseHistoryDate(date string) (time.Time, error) {
+	t, err := time.ParseInLocation("2006-01-02", date, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("日期 %s 的格式必须为2006-01-02", date)
+	}
+	return t, nil
+}
+
+// 查看指定主播的直播历史，from和to为开播日期的范围（包括这两天），为空时不限制，结果按时间从新到旧排序
+func readHistory(uid int, from, to string) ([]liveSession, error) {
+	var start, end int64 = 0, 1<<63 - 1
+	if from != "" {
+		t, err := parseHistoryDate(from)
+		if err != nil {
+			return nil, err
+		}
+		start = t.UnixMilli()
+	}
+	if to != "" {
+		t, err := parseHistoryDate(to)
+		if err != nil {
+			return nil, err
+		}
+		end = t.AddDate(0, 0, 1).UnixMilli()
+	}
+
+	return historyRange(uid, start, end, historyLimit)
+}
+
+// 获取指定主播在[start, end)开播的直播历史，limit为0时不限制数量，结果按时间从新到旧排序
+func historyRange(uid int, start, end int64, limit int) ([]liveSession, error) {
+	historyDB.Lock()
+	defer historyDB.Unlock()
+	if historyDB.db == nil {
+		return nil, fmt.Errorf("没有打开直播历史记录数据库")
+	}
+	list := []liveSession{}
+	err := historyDB.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(historyIndex).Cursor()
+		// 从结束时间往前找
+		seek := historyIndexKey(uid, end, "")
+		k, _ := c.Seek(seek)
+		if k == nil {
+			k, _ = c.Last()
+		} else {
+			k, _ = c.Prev()
+		}
+		for ; k != nil && (limit == 0 || len(list) < limit); k, _ = c.Prev() {
+			if int(binary.BigEndian.Uint64(k)) != uid || int64(binary.BigEndian.Uint64(k[8:])) < start {
+				break
+			}
+			s, err := getSession(tx, string(k[16:]))
+			if err != nil {
+				return err
+			}
+			if s != nil {
+				list = append(list, *s)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UnixMilli()
+	for i := range list {
+		s := &list[i]
+		endTime := s.EndTime
+		if endTime == 0 {
+			endTime = now
+		}
+		s.Duration = float64(endTime-s.StartTime) / 1000
+	}
+	return list, nil
+}
+
+// 获取指定主播的直播历史的JSON
+func historyJSON(uid int, from, to string) string {
+	list, err := readHistory(uid, from, to)
+	if err != nil {
+		lPrintErrf("读取%s的直播历史失败：%v", longID(uid), err)
+		return ""
+	}
+	data, err := json.MarshalIndent(list, "", "    ")
+	checkErr(err)
+	return string(data)
+}
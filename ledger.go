@@ -0,0 +1,317 @@
+// 直播礼物账本相关
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/orzogc/acfundanmu"
+)
+
+// 礼物账本文件名字
+const giftLedgerFile = "giftledger.jsonl"
+
+// 礼物账本文件位置
+var giftLedgerFileLocation string
+
+// 礼物账本文件的锁
+var giftLedgerMutex sync.Mutex
+
+// 礼物账本里的一条礼物记录
+type ledgerEntry struct {
+	LiveID     string  `json:"liveID"`     // 直播ID
+	UID        int     `json:"uid"`        // 主播uid
+	Name       string  `json:"name"`       // 主播名字
+	Time       int64   `json:"time"`       // 送礼物的时间，是以毫秒为单位的Unix时间
+	GiftName   string  `json:"giftName"`   // 礼物名字
+	Paid       bool    `json:"paid"`       // 是否付费礼物
+	Count      int64   `json:"count"`      // 礼物数量
+	Value      float64 `json:"value"`      // 礼物价值，付费礼物时单位为AC币，免费礼物时单位为香蕉
+	SenderUID  int64   `json:"senderUID"`  // 送礼物的用户uid
+	SenderName string  `json:"senderName"` // 送礼物的用户名字
+}
+
+// 送礼物的用户的统计
+type ledgerSender struct {
+	UserID      int64   `json:"userID"`      // 用户uid
+	Nickname    string  `json:"nickname"`    // 用户名字
+	GiftValue   float64 `json:"giftValue"`   // 送出的付费礼物的总价值，单位为AC币
+	BananaCount int64   `json:"bananaCount"` // 送出的香蕉总数
+}
+
+// 礼物账本的汇总
+type ledgerSummary struct {
+	LiveID      string         `json:"liveID,omitempty"` // 直播ID，按天汇总时为空
+	Date        string         `json:"date"`             // 日期，按直播汇总时为直播第一个礼物的日期
+	UID         int            `json:"uid,omitempty"`    // 主播uid，按天汇总所有主播时为0
+	Name        string         `json:"name,omitempty"`   // 主播名字
+	StartTime   int64          `json:"startTime"`        // 第一个礼物的时间，是以毫秒为单位的Unix时间
+	EndTime     int64          `json:"endTime"`          // 最后一个礼物的时间，是以毫秒为单位的Unix时间
+	GiftValue   float64        `json:"giftValue"`        // 付费礼物的总价值，单位为AC币
+	BananaCount int64          `json:"bananaCount"`      // 香蕉总数
+	Gifts       []giftStats    `json:"gifts"`            // 各种礼物的统计，按价值排序
+	Senders     []ledgerSender `json:"senders"`          // 送礼物的用户，按价值排序
+}
+
+// 将直播礼物记录到账本，实现danmuWriter，弹幕下载重启时继续使用
+type giftLedger struct {
+	s       streamer
+	liveID  string
+	entries []ledgerEntry // 还没写入文件的记录
+}
+
+// 新建giftLedger
+func newGiftLedger(s streamer, info liveInfo) *giftLedger {
+	return &giftLedger{s: s, liveID: info.LiveID}
+}
+
+// 记录一条礼物
+func (l *giftLedger) writeDanmu(d acfundanmu.DanmuMessage) error {
+	e := ledgerEntry{LiveID: l.liveID, UID: l.s.UID, Name: l.s.Name}
+	switch d := d.(type) {
+	case *acfundanmu.Gift:
+		e.Time = d.SendTime
+		e.GiftName = d.GiftName
+		e.Paid = d.PayWalletType == 1
+		e.Count = int64(d.Count) * int64(d.Combo)
+		if e.Count == 0 {
+			e.Count = int64(d.Count)
+		}
+		e.Value = float64(d.Value)
+		if e.Paid {
+			e.Value /= 1000
+		}
+		e.SenderUID = d.UserID
+		e.SenderName = d.Nickname
+	case *acfundanmu.ThrowBanana:
+		e.Time = d.SendTime
+		e.GiftName = "香蕉"
+		e.Count = int64(d.BananaCount)
+		e.Value = float64(d.BananaCount)
+		e.SenderUID = d.UserID
+		e.SenderName = d.Nickname
+	default:
+		return nil
+	}
+	l.entries = append(l.entries, e)
+	return nil
+}
+
+// 将记录写入礼物账本文件
+func (l *giftLedger) flush() error {
+	if len(l.entries) == 0 {
+		return nil
+	}
+
+	giftLedgerMutex.Lock()
+	defer giftLedgerMutex.Unlock()
+	f, err := os.OpenFile(giftLedgerFileLocation, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	for _, e := range l.entries {
+		if err = enc.Encode(e); err != nil {
+			_ = f.Close()
+			return err
+		}
+	}
+	if err = w.Flush(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	l.entries = l.entries[:0]
+	return f.Close()
+}
+
+// 弹幕下载重启时继续使用，只写入剩下的记录
+func (l *giftLedger) close() error {
+	return l.flush()
+}
+
+// 读取礼物账本，uid为0时读取所有主播的记录
+func readGiftLedger(uid int, handle func(e ledgerEntry)) error {
+	giftLedgerMutex.Lock()
+	defer giftLedgerMutex.Unlock()
+	f, err := os.Open(giftLedgerFileLocation)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var e ledgerEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return fmt.Errorf("礼物账本 %s 第%d行的格式错误：%w", giftLedgerFileLocation, n, err)
+		}
+		if uid == 0 || e.UID == uid {
+			handle(e)
+		}
+	}
+	return scanner.Err()
+}
+
+// 汇总礼物记录时使用
+type ledgerAggregate struct {
+	summary ledgerSummary
+	gifts   map[string]*giftStats
+	senders map[int64]*ledgerSender
+}
+
+// 添加一条礼物记录
+func (a *ledgerAggregate) add(e ledgerEntry) {
+	sum := &a.summary
+	if sum.StartTime == 0 || e.Time < sum.StartTime {
+		sum.StartTime = e.Time
+	}
+	if e.Time > sum.EndTime {
+		sum.EndTime = e.Time
+	}
+
+	key := fmt.Sprintf("%s-%t", e.GiftName, e.Paid)
+	g, ok := a.gifts[key]
+	if !ok {
+		g = &giftStats{GiftName: e.GiftName, Paid: e.Paid}
+		a.gifts[key] = g
+	}
+	g.Count += e.Count
+	g.Value += e.Value
+
+	sender, ok := a.senders[e.SenderUID]
+	if !ok {
+		sender = &ledgerSender{UserID: e.SenderUID}
+		a.senders[e.SenderUID] = sender
+	}
+	sender.Nickname = e.SenderName
+	if e.Paid {
+		sum.GiftValue += e.Value
+		sender.GiftValue += e.Value
+	} else {
+		sum.BananaCount += int64(e.Value)
+		sender.BananaCount += int64(e.Value)
+	}
+}
+
+// 生成汇总
+func (a *ledgerAggregate) result() ledgerSummary {
+	sum := a.summary
+	sum.Gifts = make([]giftStats, 0, len(a.gifts))
+	for _, g := range a.gifts {
+		sum.Gifts = append(sum.Gifts, *g)
+	}
+	sort.Slice(sum.Gifts, func(i, j int) bool {
+		if sum.Gifts[i].Paid != sum.Gifts[j].Paid {
+			return sum.Gifts[i].Paid
+		}
+		if sum.Gifts[i].Value != sum.Gifts[j].Value {
+			return sum.Gifts[i].Value > sum.Gifts[j].Value
+		}
+		return sum.Gifts[i].GiftName < sum.Gifts[j].GiftName
+	})
+	sum.Senders = make([]ledgerSender, 0, len(a.senders))
+	for _, sender := range a.senders {
+		sum.Senders = append(sum.Senders, *sender)
+	}
+	sort.Slice(sum.Senders, func(i, j int) bool {
+		if sum.Senders[i].GiftValue != sum.Senders[j].GiftValue {
+			return sum.Senders[i].GiftValue > sum.Senders[j].GiftValue
+		}
+		if sum.Senders[i].BananaCount != sum.Senders[j].BananaCount {
+			return sum.Senders[i].BananaCount > sum.Senders[j].BananaCount
+		}
+		return sum.Senders[i].UserID < sum.Senders[j].UserID
+	})
+	return sum
+}
+
+// 按key汇总礼物账本，结果按时间从新到旧排序
+func summarizeGiftLedger(uid int, key func(e ledgerEntry) string, init func(e ledgerEntry) ledgerSummary) ([]ledgerSummary, error) {
+	aggs := make(map[string]*ledgerAggregate)
+	err := readGiftLedger(uid, func(e ledgerEntry) {
+		k := key(e)
+		a, ok := aggs[k]
+		if !ok {
+			a = &ledgerAggregate{
+				summary: init(e),
+				gifts:   make(map[string]*giftStats),
+				senders: make(map[int64]*ledgerSender),
+			}
+			aggs[k] = a
+		}
+		a.add(e)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]ledgerSummary, 0, len(aggs))
+	for _, a := range aggs {
+		list = append(list, a.result())
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].StartTime > list[j].StartTime
+	})
+	return list, nil
+}
+
+// 获取礼物记录的日期
+func ledgerDate(e ledgerEntry) string {
+	return time.UnixMilli(e.Time).Format("2006-01-02")
+}
+
+// 按直播汇总礼物账本，uid为0时汇总所有主播
+func giftSessions(uid int) ([]ledgerSummary, error) {
+	return summarizeGiftLedger(uid,
+		func(e ledgerEntry) string { return e.LiveID },
+		func(e ledgerEntry) ledgerSummary {
+			return ledgerSummary{LiveID: e.LiveID, Date: ledgerDate(e), UID: e.UID, Name: e.Name}
+		})
+}
+
+// 按天汇总礼物账本，uid为0时汇总所有主播
+func giftDays(uid int) ([]ledgerSummary, error) {
+	return summarizeGiftLedger(uid,
+		ledgerDate,
+		func(e ledgerEntry) ledgerSummary {
+			if uid == 0 {
+				return ledgerSummary{Date: ledgerDate(e)}
+			}
+			return ledgerSummary{Date: ledgerDate(e), UID: e.UID, Name: e.Name}
+		})
+}
+
+// 获取礼物账本汇总的JSON，summary为session或day
+func giftLedgerJSON(summary string, uid int) string {
+	var list []ledgerSummary
+	var err error
+	switch summary {
+	case "session":
+		list, err = giftSessions(uid)
+	case "day":
+		list, err = giftDays(uid)
+	default:
+		lPrintErrf("礼物账本的汇总方式必须是session或day：%s", summary)
+		return ""
+	}
+	if err != nil {
+		lPrintErrf("读取礼物账本失败：%v", err)
+		return ""
+	}
+	data, err := json.MarshalIndent(list, "", "    ")
+	checkErr(err)
+	return string(data)
+}
@@ -9,6 +9,8 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/orzogc/acfundanmu"
@@ -35,10 +37,96 @@ func argsHandle() {
 	startRecord := flag.Uint("startrecord", 0, "临时下载指定主播的直播视频，需要主播的uid（在主播的网页版个人主页查看）")
 	startDlDanmu := flag.Uint("startdanmu", 0, "临时下载指定主播的直播弹幕，需要主播的uid（在主播的网页版个人主页查看）")
 	startRecDanmu := flag.Uint("startrecdan", 0, "临时下载指定主播的直播视频和弹幕，需要主播的uid（在主播的网页版个人主页查看）")
+	watchDanmuUID := flag.Uint("watchdanmu", 0, "在终端查看指定主播的直播弹幕、礼物和进入直播间，不写入任何文件，按Ctrl+C停止，需要主播的uid（在主播的网页版个人主页查看）")
 	configDir = flag.String("config", "", "设置文件所在文件夹，默认是本程序所在文件夹")
 	recordDir = flag.String("record", "", "下载录播和弹幕文件到该文件夹，默认是本程序所在文件夹")
+	convertFile := flag.String("convertdanmu", "", "将弹幕存档（jsonl或jsonl.gz文件）转换为其他格式的弹幕文件，不需要连接AcFun，转换后的文件和弹幕存档放在一起")
+	convertFormat := flag.String("format", danmuFormatASS, "-convertdanmu 转换后的弹幕文件格式，可以是ass、xml、srt、vtt或html")
+	resX := flag.Int("resx", 1920, "-convertdanmu 转换时的视频分辨率宽度")
+	resY := flag.Int("resy", 1080, "-convertdanmu 转换时的视频分辨率高度")
+	fontSize := flag.Int("fontsize", 0, "-convertdanmu 转换时的弹幕字体大小，为0时根据分辨率自动设置")
+	offset := flag.Duration("offset", 0, "-convertdanmu 转换时弹幕时间的偏移，比如3.5s，为正时弹幕延后出现，为负时弹幕提前出现")
+	exclude := flag.String("exclude", "", "-convertdanmu 转换时去掉内容符合该正则表达式的弹幕")
+	force := flag.Bool("force", false, "-convertdanmu 转换后的文件已经存在（比如下载弹幕时生成的弹幕文件）时覆盖该文件")
+	ledgerSummary := flag.String("giftledger", "", "按直播（session）或按天（day）汇总礼物账本"+giftLedgerFile+"，不需要连接AcFun")
+	ledgerUID := flag.Uint("ledgeruid", 0, "-giftledger 只汇总指定主播的礼物，需要主播的uid（在主播的网页版个人主页查看），为0时汇总所有主播")
+	highlightFile := flag.String("highlight", "", "根据弹幕存档（jsonl或jsonl.gz文件）的弹幕和礼物密度无损剪辑录播文件的精彩片段，需要用-video指定录播文件，不需要连接AcFun，片段和索引文件和录播文件放在一起")
+	videoFile := flag.String("video", "", "-highlight 剪辑的录播文件")
+	mockFile := flag.String("mockserver", "", "按剧本文件运行模拟AcFun服务器，提供直播间列表、直播信息、直播源（本地视频）和弹幕，config.json里的endpoints改为该服务器的地址并设置mock为true后可以离线测试开播提醒和下载")
 	flag.Parse()
 
+	// 汇总礼物账本不需要连接AcFun
+	if *ledgerSummary != "" {
+		*isNoGUI = true
+		initConfigDir()
+		data := giftLedgerJSON(*ledgerSummary, int(*ledgerUID))
+		if data == "" {
+			os.Exit(1)
+		}
+		fmt.Println(data)
+		return
+	}
+
+	// 转换弹幕存档不需要连接AcFun
+	if *convertFile != "" {
+		*isNoGUI = true
+		initConfigDir()
+		loadConfig()
+		loadLiveConfig()
+		opt := convertOption{
+			format:   strings.ToLower(*convertFormat),
+			resX:     *resX,
+			resY:     *resY,
+			fontSize: *fontSize,
+			offset:   *offset,
+			force:    *force,
+		}
+		if opt.resX <= 0 || opt.resY <= 0 || opt.fontSize < 0 {
+			lPrintErr("-resx和-resy必须大于0，-fontsize必须大于等于0")
+			os.Exit(1)
+		}
+		if *exclude != "" {
+			re, err := regexp.Compile(*exclude)
+			if err != nil {
+				lPrintErrf("-exclude的正则表达式错误：%v", err)
+				os.Exit(1)
+			}
+			opt.exclude = re
+		}
+		if _, err := convertDanmu(*convertFile, opt); err != nil {
+			lPrintErrf("转换弹幕存档 %s 失败：%v", *convertFile, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// 剪辑精彩片段不需要连接AcFun
+	if *highlightFile != "" {
+		*isNoGUI = true
+		initConfigDir()
+		loadConfig()
+		if *videoFile == "" {
+			lPrintErr("需要用-video指定录播文件")
+			os.Exit(1)
+		}
+		if err := highlightArchive(*highlightFile, *videoFile); err != nil {
+			lPrintErrf("剪辑录播文件 %s 的精彩片段失败：%v", *videoFile, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// 模拟AcFun服务器不需要连接AcFun
+	if *mockFile != "" {
+		*isNoGUI = true
+		initConfigDir()
+		if err := runMockServer(*mockFile); err != nil {
+			lPrintErrf("运行模拟AcFun服务器失败：%v", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	initialize()
 
 	if flag.NArg() != 0 {
@@ -116,6 +204,9 @@ func argsHandle() {
 		if *startRecDanmu != 0 {
 			startRecDan(int(*startRecDanmu))
 		}
+		if *watchDanmuUID != 0 {
+			watchDanmu(int(*watchDanmuUID))
+		}
 	}
 }
 
@@ -141,17 +232,66 @@ func checkConfig() {
 		lPrintErr(configFile + "里的QQ号必须大于等于0")
 		os.Exit(1)
 	}
+	if config.Quality.BlackDuration <= 0 || config.Quality.FreezeDuration <= 0 || config.Quality.SilenceDuration <= 0 {
+		lPrintErr(configFile + "里quality的blackDuration、freezeDuration和silenceDuration必须大于0")
+		os.Exit(1)
+	}
+	if config.Quality.AlertInterval < 0 {
+		lPrintErr(configFile + "里quality的alertInterval必须大于等于0")
+		os.Exit(1)
+	}
+	if config.TextSub.MaxLines <= 0 || config.TextSub.Duration <= 0 {
+		lPrintErr(configFile + "里textSub的maxLines和duration必须大于0")
+		os.Exit(1)
+	}
+	if config.WatchInterval < 0 {
+		lPrintErr(configFile + "里的watchInterval必须大于等于0")
+		os.Exit(1)
+	}
+	if config.MetricsInterval <= 0 {
+		lPrintErr(configFile + "里的metricsInterval必须大于0")
+		os.Exit(1)
+	}
+	if config.RoomPageSize <= 0 {
+		lPrintErr(configFile + "里的roomPageSize必须大于0")
+		os.Exit(1)
+	}
+	if config.Interval.FetchRooms <= 0 || config.Interval.Medals <= 0 || config.Interval.Retry <= 0 || config.Interval.MaxBackoff < config.Interval.Retry {
+		lPrintErr(configFile + "里interval的fetchRooms、medals和retry必须大于0，maxBackoff必须大于等于retry")
+		os.Exit(1)
+	}
+	if config.RateLimit.Rate < 0 || config.RateLimit.Burst < 1 {
+		lPrintErr(configFile + "里rateLimit的rate必须大于等于0，burst必须大于0")
+		os.Exit(1)
+	}
+	if err := config.Endpoints.normalize(); err != nil {
+		lPrintErrf("%s里的endpoints设置错误：%v", configFile, err)
+		os.Exit(1)
+	}
+	if err := setupProxy(); err != nil {
+		lPrintErrf("%s里的proxy设置错误：%v", configFile, err)
+		os.Exit(1)
+	}
+	if config.Schedule.Weeks <= 0 || config.Schedule.Regular <= 0 || config.Schedule.Regular > 1 || config.Schedule.Grace < 0 {
+		lPrintErr(configFile + "里schedule的weeks必须大于0，regular必须大于0且小于等于1，grace必须大于等于0")
+		os.Exit(1)
+	}
+	if config.Highlight.Clips <= 0 || config.Highlight.Window < 1 || config.Highlight.Padding < 0 || config.Highlight.GiftWeight < 0 {
+		lPrintErr(configFile + "里highlight的clips必须大于0，window必须大于等于1，padding和giftWeight必须大于等于0")
+		os.Exit(1)
+	}
+	if config.Filter.DedupWindow < 0 || config.Filter.MaxLength < 0 {
+		lPrintErr(configFile + "里filter的dedupWindow和maxLength必须大于等于0")
+		os.Exit(1)
+	}
+	if config.BurnIn.Codec == "" || config.BurnIn.Quality < 0 {
+		lPrintErr(configFile + "里burnIn的codec不能为空，quality必须大于等于0")
+		os.Exit(1)
+	}
 }
 
-// 程序初始化
-func initialize() {
-	initTray()
-
-	// 避免 initialization loop
-	boolDispatch["startwebapi"] = startWebAPI
-	boolDispatch["startwebui"] = startWebUI
-	boolDispatch["startmirai"] = startMirai
-
+// 初始化设置文件所在文件夹和设置文件位置
+func initConfigDir() {
 	exePath, err := os.Executable()
 	checkErr(err)
 	exeDir = filepath.Dir(exePath)
@@ -168,7 +308,23 @@ func initialize() {
 	logoFileLocation = filepath.Join(*configDir, logoFile)
 	liveFileLocation = filepath.Join(*configDir, liveFile)
 	configFileLocation = filepath.Join(*configDir, configFile)
+	giftLedgerFileLocation = filepath.Join(*configDir, giftLedgerFile)
+	moderationLogFileLocation = filepath.Join(*configDir, moderationLogFile)
+	historyFileLocation = filepath.Join(*configDir, historyFile)
+}
+
+// 程序初始化
+func initialize() {
+	initTray()
+
+	// 避免 initialization loop
+	boolDispatch["startwebapi"] = startWebAPI
+	boolDispatch["startwebui"] = startWebUI
+	boolDispatch["startmirai"] = startMirai
+
+	initConfigDir()
 
+	var err error
 	if _, err := os.Stat(logoFileLocation); os.IsNotExist(err) {
 		lPrintln("下载AcFun的logo")
 		fetchAcLogo()
@@ -189,6 +345,9 @@ func initialize() {
 
 	sInfoMap.info = make(map[int]*streamerInfo)
 	lInfoMap.info = make(map[string]liveInfo)
+	danmuReports.report = make(map[int]danmuReport)
+	highlightTimelines.timeline = make(map[string]*highlightTimeline)
+	danmuViewers.cancel = make(map[int]context.CancelFunc)
 	streamers.crt = make(map[int]streamer)
 	streamers.old = make(map[int]streamer)
 	loadLiveConfig()
@@ -199,15 +358,26 @@ func initialize() {
 		streamers.old[uid] = s
 	}
 
-	deviceID, err = acfundanmu.GetDeviceID()
-	checkErr(err)
+	if config.Endpoints.Mock {
+		// 模拟AcFun服务器不需要deviceID
+		deviceID = "mock"
+		lPrintln("连接模拟AcFun服务器 " + config.Endpoints.Live)
+	} else {
+		deviceID, err = acfundanmu.GetDeviceID()
+		checkErr(err)
+	}
 
 	if ok := fetchAllRooms(); !ok {
 		os.Exit(1)
 	}
 	liveRooms.rooms = liveRooms.newRooms
 
-	if config.Acfun.Account != "" && config.Acfun.Password != "" {
+	openHistory()
+	historyStartup()
+
+	if config.Endpoints.Mock && config.Acfun.Account != "" {
+		lPrintWarn("连接模拟AcFun服务器时不登陆AcFun帐号")
+	} else if config.Acfun.Account != "" && config.Acfun.Password != "" {
 		err = acfun_login()
 		if err != nil {
 			lPrintErrf("登陆AcFun帐号时出现错误，取消登陆：%v", err)
@@ -277,6 +447,10 @@ func main() {
 			go cycleGetMedals(ctx)
 		}
 
+		if config.Schedule.WarnMissed {
+			go cycleSchedule(ctx)
+		}
+
 	Outer:
 		for msg := range mainCh {
 			switch msg.c {
@@ -326,6 +500,7 @@ func main() {
 				lInfoMap.RUnlock()
 				// 等待20秒，等待其他goroutine结束
 				time.Sleep(20 * time.Second)
+				closeHistory()
 				break Outer
 			default:
 				lPrintErrf("未知controlMsg：%+v", msg)
@@ -0,0 +1,180 @@
+// 直播间观众数据相关
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/orzogc/acfundanmu"
+)
+
+// 观众数据csv文件的开头
+const metricsCSVHeader = "time,watchingCount,likeCount,likeDelta,bananaCount\n"
+
+// 一次采样的直播间观众数据
+type metricsSample struct {
+	Time          int64 `json:"time"`          // 采样的时间，是以毫秒为单位的Unix时间
+	WatchingCount int64 `json:"watchingCount"` // 直播间在线观众数量
+	LikeCount     int64 `json:"likeCount"`     // 直播间点赞总数
+	LikeDelta     int   `json:"likeDelta"`     // 点赞增加数量
+	BananaCount   int64 `json:"bananaCount"`   // 直播间香蕉总数
+}
+
+// 一场直播的观众数据
+type metricsReport struct {
+	UID      int                 `json:"uid"`      // 主播uid
+	Name     string              `json:"name"`     // 主播名字
+	LiveID   string              `json:"liveID"`   // 直播ID
+	Title    string              `json:"title"`    // 直播间标题
+	Interval float64             `json:"interval"` // 采样间隔秒数
+	Samples  []metricsSample     `json:"samples"`  // 按时间排序的采样数据
+	Summary  *acfundanmu.Summary `json:"summary"`  // 直播结束后AcFun的直播总结，包括观看过直播的人数总数，获取失败时为null
+}
+
+// 转换AcFun显示的数量，比如"1.2万"
+func parseCount(s string) int64 {
+	s = strings.TrimSpace(s)
+	multiplier := 1.0
+	if strings.HasSuffix(s, "万") {
+		s = strings.TrimSuffix(s, "万")
+		multiplier = 10000
+	} else if strings.HasSuffix(s, "亿") {
+		s = strings.TrimSuffix(s, "亿")
+		multiplier = 100000000
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0
+	}
+	return int64(f * multiplier)
+}
+
+// 定时采样直播间观众数据，弹幕下载重启时继续使用
+type metricsRecorder struct {
+	sync.Mutex
+	s       streamer
+	info    liveInfo
+	samples []metricsSample
+	csv     *os.File
+	ac      *acfundanmu.AcFunLive // 最近一次连接的直播间，用来获取直播总结
+}
+
+// 获取观众数据文件的路径
+func (info *liveInfo) metricsFiles() (csvFile, jsonFile string) {
+	return info.danmuFile(".metrics.csv"), info.danmuFile(".metrics.json")
+}
+
+// 新建metricsRecorder，采样数据会同时追加写入csv文件
+func newMetricsRecorder(s streamer, info liveInfo) *metricsRecorder {
+	m := &metricsRecorder{s: s, info: info}
+	csvFile, _ := info.metricsFiles()
+	f, err := os.OpenFile(csvFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		lPrintErrf("无法写入%s的观众数据文件：%v", s.longID(), err)
+		return m
+	}
+	if _, err = f.WriteString(metricsCSVHeader); err != nil {
+		lPrintErrf("无法写入%s的观众数据文件：%v", s.longID(), err)
+		_ = f.Close()
+		return m
+	}
+	m.csv = f
+	return m
+}
+
+// 在ac连接期间定时采样，ctx结束时停止
+func (m *metricsRecorder) run(ctx context.Context, ac *acfundanmu.AcFunLive) {
+	m.Lock()
+	m.ac = ac
+	m.Unlock()
+
+	ticker := time.NewTicker(time.Duration(config.MetricsInterval * float64(time.Second)))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.sample(ac)
+		}
+	}
+}
+
+// 采样一次
+func (m *metricsRecorder) sample(ac *acfundanmu.AcFunLive) {
+	info := ac.GetLiveInfo()
+	// 还没有收到直播间的状态信息
+	if info.WatchingCount == "" && info.LikeCount == "" {
+		return
+	}
+	sample := metricsSample{
+		Time:          time.Now().UnixMilli(),
+		WatchingCount: parseCount(info.WatchingCount),
+		LikeCount:     parseCount(info.LikeCount),
+		LikeDelta:     info.LikeDelta,
+		BananaCount:   parseCount(info.AllBananaCount),
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	m.samples = append(m.samples, sample)
+	if m.csv != nil {
+		_, err := fmt.Fprintf(m.csv, "%d,%d,%d,%d,%d\n",
+			sample.Time, sample.WatchingCount, sample.LikeCount, sample.LikeDelta, sample.BananaCount)
+		if err != nil {
+			lPrintErrf("写入%s的观众数据时出现错误：%v", m.s.longID(), err)
+		}
+	}
+}
+
+// 结束采样并保存json文件
+func (m *metricsRecorder) save() {
+	defer func() {
+		if err := recover(); err != nil {
+			lPrintErr("Recovering from panic in save(), the error is:", err)
+			lPrintErrf("保存%s的观众数据时发生错误", m.s.longID())
+		}
+	}()
+
+	m.Lock()
+	defer m.Unlock()
+	if m.csv != nil {
+		if err := m.csv.Close(); err != nil {
+			lPrintErrf("写入%s的观众数据时出现错误：%v", m.s.longID(), err)
+		}
+		m.csv = nil
+	}
+
+	r := metricsReport{
+		UID:      m.s.UID,
+		Name:     m.s.Name,
+		LiveID:   m.info.LiveID,
+		Title:    m.info.Title,
+		Interval: config.MetricsInterval,
+		Samples:  m.samples,
+	}
+	if r.Samples == nil {
+		r.Samples = []metricsSample{}
+	}
+	if m.ac != nil {
+		summary, err := m.ac.GetSummary(m.info.LiveID)
+		if err != nil {
+			lPrintErrf("获取%s的直播总结失败：%v", m.s.longID(), err)
+		} else {
+			r.Summary = summary
+		}
+	}
+
+	csvFile, jsonFile := m.info.metricsFiles()
+	data, err := json.MarshalIndent(r, "", "    ")
+	checkErr(err)
+	err = os.WriteFile(jsonFile, data, 0644)
+	checkErr(err)
+	lPrintln(m.s.longID() + "的观众数据保存在" + csvFile + " " + jsonFile)
+}
@@ -0,0 +1,536 @@
+// 模拟AcFun服务器相关
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/orzogc/acfundanmu"
+	"github.com/valyala/fasthttp"
+)
+
+// 模拟服务器的默认端口
+const mockDefaultPort = 51881
+
+// 没有弹幕存档时生成模拟弹幕的间隔
+const mockDanmuInterval = 2 * time.Second
+
+// 模拟服务器里的一场直播
+type mockRoom struct {
+	UID     int     `json:"uid"`     // 主播uid
+	Name    string  `json:"name"`    // 主播名字
+	Title   string  `json:"title"`   // 直播间标题
+	LiveID  string  `json:"liveID"`  // 直播ID，为空时自动生成
+	Video   string  `json:"video"`   // 作为直播源的本地视频文件，相对路径是相对于剧本文件所在文件夹
+	Bitrate int     `json:"bitrate"` // 发送视频的码率（Kbps），最好和视频的码率一致，为0时是2000
+	Danmu   string  `json:"danmu"`   // 按原来的时间间隔重放的弹幕存档（jsonl或jsonl.gz文件），为空时定时生成模拟弹幕
+	Start   float64 `json:"start"`   // 模拟服务器启动后多少秒开播
+	End     float64 `json:"end"`     // 模拟服务器启动后多少秒下播，为0时一直直播
+	Medal   bool    `json:"medal"`   // 登陆的帐号是否有该主播的守护徽章
+
+	danmu []archiveLine // 弹幕存档里的弹幕
+}
+
+// 模拟服务器的剧本
+type mockScript struct {
+	Port  int         `json:"port"`  // 模拟服务器的本地端口，为0时是51881
+	Rooms []*mockRoom `json:"rooms"` // 按剧本开播和下播的直播
+}
+
+// 模拟AcFun服务器
+type mockServer struct {
+	script *mockScript
+	start  time.Time
+}
+
+// 读取剧本
+func loadMockScript(file string) (*mockScript, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	script := new(mockScript)
+	if err := json.Unmarshal(data, script); err != nil {
+		return nil, fmt.Errorf("剧本 %s 的格式错误：%w", file, err)
+	}
+	if script.Port == 0 {
+		script.Port = mockDefaultPort
+	}
+
+	dir := filepath.Dir(file)
+	for i, room := range script.Rooms {
+		if room.UID <= 0 {
+			return nil, fmt.Errorf("剧本 %s 里第%d场直播的uid必须大于0", file, i+1)
+		}
+		if room.End != 0 && room.End <= room.Start {
+			return nil, fmt.Errorf("剧本 %s 里第%d场直播的end必须大于start", file, i+1)
+		}
+		if room.Name == "" {
+			room.Name = "模拟主播" + strconv.Itoa(room.UID)
+		}
+		if room.LiveID == "" {
+			room.LiveID = fmt.Sprintf("mock%d_%d", room.UID, i+1)
+		}
+		if room.Bitrate <= 0 {
+			room.Bitrate = 2000
+		}
+		if room.Video != "" && !filepath.IsAbs(room.Video) {
+			room.Video = filepath.Join(dir, room.Video)
+		}
+		if room.Danmu != "" {
+			if !filepath.IsAbs(room.Danmu) {
+				room.Danmu = filepath.Join(dir, room.Danmu)
+			}
+			err := readArchive(room.Danmu, func(_ *archiveHeaderData, d acfundanmu.DanmuMessage) error {
+				data, err := json.Marshal(d)
+				if err != nil {
+					return err
+				}
+				room.danmu = append(room.danmu, archiveLine{Type: archiveType(d), Time: d.GetSendTime(), Data: data})
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return script, nil
+}
+
+// 获取指定主播现在的直播，不在直播时返回nil
+func (m *mockServer) live(uid int) *mockRoom {
+	t := time.Since(m.start).Seconds()
+	for _, room := range m.script.Rooms {
+		if room.UID == uid && t >= room.Start && (room.End == 0 || t < room.End) {
+			return room
+		}
+	}
+	return nil
+}
+
+// 获取现在所有的直播，按uid排序
+func (m *mockServer) lives() []*mockRoom {
+	uids := make(map[int]bool)
+	var rooms []*mockRoom
+	for _, room := range m.script.Rooms {
+		if uids[room.UID] {
+			continue
+		}
+		if r := m.live(room.UID); r != nil {
+			uids[room.UID] = true
+			rooms = append(rooms, r)
+		}
+	}
+	sort.Slice(rooms, func(i, j int) bool {
+		return rooms[i].UID < rooms[j].UID
+	})
+	return rooms
+}
+
+// 写入JSON响应
+func writeMockJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	data, err := json.Marshal(v)
+	checkErr(err)
+	_, _ = w.Write(data)
+}
+
+// 获取路径里的uid
+func mockUID(r *http.Request) int {
+	uid, _ := strconv.Atoi(mux.Vars(r)["uid"])
+	return uid
+}
+
+// 直播间的JSON
+func (room *mockRoom) liveJSON() map[string]any {
+	return map[string]any{
+		"authorId": room.UID,
+		"liveId":   room.LiveID,
+		"title":    room.Title,
+		"user":     map[string]any{"name": room.Name},
+	}
+}
+
+// 分页的直播间列表，pcursor是下一页开始的序号
+func (m *mockServer) channelList(w http.ResponseWriter, r *http.Request) {
+	rooms := m.lives()
+	count, err := strconv.Atoi(r.FormValue("count"))
+	if err != nil || count <= 0 {
+		count = len(rooms)
+	}
+	offset, _ := strconv.Atoi(r.FormValue("pcursor"))
+	if offset < 0 || offset > len(rooms) {
+		offset = len(rooms)
+	}
+	end := offset + count
+	pcursor := strconv.Itoa(end)
+	if end >= len(rooms) {
+		end = len(rooms)
+		pcursor = "no_more"
+	}
+
+	list := make([]map[string]any, 0, end-offset)
+	for _, room := range rooms[offset:end] {
+		list = append(list, room.liveJSON())
+	}
+	writeMockJSON(w, map[string]any{
+		"channelListData": map[string]any{
+			"result":   0,
+			"pcursor":  pcursor,
+			"liveList": list,
+		},
+	})
+}
+
+// 主播的直播信息
+func (m *mockServer) liveInfo(w http.ResponseWriter, r *http.Request) {
+	uid, _ := strconv.Atoi(r.FormValue("authorId"))
+	if room := m.live(uid); room != nil {
+		info := room.liveJSON()
+		info["result"] = 0
+		writeMockJSON(w, info)
+		return
+	}
+	name := "模拟主播" + strconv.Itoa(uid)
+	for _, room := range m.script.Rooms {
+		if room.UID == uid {
+			name = room.Name
+			break
+		}
+	}
+	writeMockJSON(w, map[string]any{"result": 0, "user": map[string]any{"name": name}})
+}
+
+// wap版直播间网页
+func (m *mockServer) mobilePage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if room := m.live(mockUID(r)); room != nil {
+		fmt.Fprintf(w, "<html><body><p class=\"title\">%s</p></body></html>", html.EscapeString(room.Title))
+		return
+	}
+	fmt.Fprint(w, "<html><body><p class=\"closed-tip\">直播已结束</p></body></html>")
+}
+
+// 网页版直播间
+func (m *mockServer) livePage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	uid := mockUID(r)
+	if room := m.live(uid); room != nil {
+		fmt.Fprintf(w, "<html><body><h1>%s</h1><video src=\"/mock/video/%d.flv\" controls></video></body></html>", html.EscapeString(room.Title), uid)
+		return
+	}
+	fmt.Fprint(w, "<html><body><h1>直播已结束</h1></body></html>")
+}
+
+// 登陆帐号的守护徽章列表
+func (m *mockServer) medalList(w http.ResponseWriter, r *http.Request) {
+	uids := make(map[int]bool)
+	list := []map[string]any{}
+	for _, room := range m.script.Rooms {
+		if room.Medal && !uids[room.UID] {
+			uids[room.UID] = true
+			list = append(list, map[string]any{"uperId": room.UID, "uperName": room.Name})
+		}
+	}
+	writeMockJSON(w, map[string]any{"result": 0, "medalList": list})
+}
+
+// 直播源信息，直播源链接需要包含flv?
+func (m *mockServer) streamInfo(w http.ResponseWriter, r *http.Request) {
+	uid := mockUID(r)
+	room := m.live(uid)
+	if room == nil {
+		writeMockJSON(w, map[string]any{"result": 1, "error_msg": "主播不在直播"})
+		return
+	}
+	info := acfundanmu.StreamInfo{
+		LiveID:        room.LiveID,
+		Title:         room.Title,
+		LiveStartTime: m.start.Add(time.Duration(room.Start * float64(time.Second))).UnixMilli(),
+		StreamName:    room.LiveID,
+		StreamList: []acfundanmu.StreamURL{{
+			URL:         fmt.Sprintf("http://%s/mock/video/%d.flv?liveID=%s", r.Host, uid, room.LiveID),
+			Bitrate:     room.Bitrate,
+			QualityType: "HIGH",
+			QualityName: "模拟",
+		}},
+	}
+	writeMockJSON(w, map[string]any{"result": 0, "streamInfo": info})
+}
+
+// 按码率发送视频文件，模拟直播源，下播时断开
+func (m *mockServer) video(w http.ResponseWriter, r *http.Request) {
+	uid := mockUID(r)
+	room := m.live(uid)
+	if room == nil || room.Video == "" {
+		http.NotFound(w, r)
+		return
+	}
+	f, err := os.Open(room.Video)
+	if err != nil {
+		lPrintErrf("打开模拟直播源 %s 失败：%v", room.Video, err)
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "video/x-flv")
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, 32*1024)
+	// 每块数据按码率需要的时间
+	chunk := time.Duration(float64(len(buf)) * 8 / float64(room.Bitrate*1000) * float64(time.Second))
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err != nil {
+			return
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(chunk):
+		}
+		if m.live(uid) != room {
+			return
+		}
+	}
+}
+
+// 将一条弹幕的发送时间改为t
+func setSendTime(d acfundanmu.DanmuMessage, t int64) {
+	switch d := d.(type) {
+	case *acfundanmu.Comment:
+		d.SendTime = t
+	case *acfundanmu.Like:
+		d.SendTime = t
+	case *acfundanmu.EnterRoom:
+		d.SendTime = t
+	case *acfundanmu.FollowAuthor:
+		d.SendTime = t
+	case *acfundanmu.ThrowBanana:
+		d.SendTime = t
+	case *acfundanmu.Gift:
+		d.SendTime = t
+	case *acfundanmu.JoinClub:
+		d.JoinTime = t
+	case *acfundanmu.ShareLive:
+		d.SendTime = t
+	}
+}
+
+// 以弹幕存档的格式持续发送弹幕，下播时断开
+func (m *mockServer) danmu(w http.ResponseWriter, r *http.Request) {
+	uid := mockUID(r)
+	room := m.live(uid)
+	if room == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson; charset=utf-8")
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	send := func(d acfundanmu.DanmuMessage) bool {
+		now := time.Now().UnixMilli()
+		setSendTime(d, now)
+		err := enc.Encode(archiveRecord{Version: danmuArchiveVersion, Type: archiveType(d), Time: now, Data: d})
+		if err != nil {
+			return false
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return true
+	}
+	// 等待到下一条弹幕的时间，下播或断开时返回false
+	wait := func(d time.Duration) bool {
+		select {
+		case <-r.Context().Done():
+			return false
+		case <-time.After(d):
+		}
+		return m.live(uid) == room
+	}
+
+	// 按弹幕存档原来的时间间隔重放
+	if len(room.danmu) != 0 {
+		first := room.danmu[0].Time
+		start := time.Now()
+		for i := range room.danmu {
+			line := room.danmu[i]
+			if !wait(time.Until(start.Add(time.Duration(line.Time-first) * time.Millisecond))) {
+				return
+			}
+			d, err := decodeArchiveData(&line)
+			if err != nil || d == nil {
+				continue
+			}
+			if !send(d) {
+				return
+			}
+		}
+		// 重放完后保持连接直到下播
+		for wait(time.Second) {
+		}
+		return
+	}
+
+	// 定时生成模拟弹幕
+	for n := 1; wait(mockDanmuInterval); n++ {
+		user := acfundanmu.UserInfo{UserID: int64(10000 + n%5), Nickname: fmt.Sprintf("模拟观众%d", n%5)}
+		var d acfundanmu.DanmuMessage
+		if n%10 == 0 {
+			d = &acfundanmu.ThrowBanana{DanmuCommon: acfundanmu.DanmuCommon{UserInfo: user}, BananaCount: 1}
+		} else {
+			d = &acfundanmu.Comment{DanmuCommon: acfundanmu.DanmuCommon{UserInfo: user}, Content: fmt.Sprintf("模拟弹幕%d", n)}
+		}
+		if !send(d) {
+			return
+		}
+	}
+}
+
+// 运行模拟AcFun服务器，按Ctrl+C结束
+func runMockServer(file string) error {
+	script, err := loadMockScript(file)
+	if err != nil {
+		return err
+	}
+	m := &mockServer{script: script, start: time.Now()}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/api/channel/list", m.channelList)
+	r.HandleFunc("/api/live/info", m.liveInfo)
+	r.HandleFunc("/live/detail/{uid:[0-9]+}", m.mobilePage)
+	r.HandleFunc("/live/{uid:[0-9]+}", m.livePage)
+	r.HandleFunc("/rest/pc-direct/fansClub/fans/medal/list", m.medalList)
+	r.HandleFunc("/mock/stream/{uid:[0-9]+}", m.streamInfo)
+	r.HandleFunc("/mock/video/{uid:[0-9]+}.flv", m.video)
+	r.HandleFunc("/mock/danmu/{uid:[0-9]+}", m.danmu)
+
+	srv := &http.Server{
+		Addr:    fmt.Sprintf(":%d", script.Port),
+		Handler: r,
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		_ = srv.Shutdown(context.Background())
+	}()
+
+	lPrintf("模拟AcFun服务器运行在 http://localhost:%d ，共%d场直播，按Ctrl+C结束", script.Port, len(script.Rooms))
+	for _, room := range script.Rooms {
+		end := "一直直播"
+		if room.End != 0 {
+			end = fmt.Sprintf("%g秒后下播", room.End)
+		}
+		lPrintf("%s（%d）：%g秒后开播，%s，标题：%s", room.Name, room.UID, room.Start, end, room.Title)
+	}
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// 从模拟AcFun服务器获取直播源信息
+func fetchMockStreamInfo(uid int) (info *acfundanmu.StreamInfo, e error) {
+	defer func() {
+		if err := recover(); err != nil {
+			e = fmt.Errorf("fetchMockStreamInfo() error: %v", err)
+		}
+	}()
+
+	client := &httpClient{
+		url:    fmt.Sprintf("%s/mock/stream/%d", config.Endpoints.Live, uid),
+		method: fasthttp.MethodGet,
+	}
+	resp, err := client.doRequest()
+	checkErr(err)
+	defer fasthttp.ReleaseResponse(resp)
+
+	var result struct {
+		Result     int                   `json:"result"`
+		ErrorMsg   string                `json:"error_msg"`
+		StreamInfo acfundanmu.StreamInfo `json:"streamInfo"`
+	}
+	err = json.Unmarshal(getBody(resp), &result)
+	checkErr(err)
+	if result.Result != 0 {
+		return nil, fmt.Errorf("模拟AcFun服务器返回错误：%s", result.ErrorMsg)
+	}
+	return &result.StreamInfo, nil
+}
+
+// 从模拟AcFun服务器接收的弹幕，实现danmuSource
+type mockDanmu struct {
+	ch chan []acfundanmu.DanmuMessage
+}
+
+// 连接模拟AcFun服务器，开始接收弹幕
+func newMockDanmu(ctx context.Context, uid int) *mockDanmu {
+	m := &mockDanmu{ch: make(chan []acfundanmu.DanmuMessage, 100)}
+	go func() {
+		defer close(m.ch)
+		url := fmt.Sprintf("%s/mock/danmu/%d", config.Endpoints.Live, uid)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			lPrintErrf("连接模拟AcFun服务器失败：%v", err)
+			return
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			lPrintErrf("连接模拟AcFun服务器失败：%v", err)
+			return
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			_, _ = io.Copy(io.Discard, resp.Body)
+			return
+		}
+
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			var line archiveLine
+			if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+				lPrintErrf("模拟AcFun服务器的弹幕格式错误：%v", err)
+				return
+			}
+			d, err := decodeArchiveData(&line)
+			if err != nil || d == nil {
+				continue
+			}
+			select {
+			case m.ch <- []acfundanmu.DanmuMessage{d}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return m
+}
+
+// 获取弹幕，连接断开时返回nil
+func (m *mockDanmu) GetDanmu() []acfundanmu.DanmuMessage {
+	return <-m.ch
+}
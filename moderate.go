@@ -0,0 +1,288 @@
+// 直播间房管相关
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/orzogc/acfundanmu"
+)
+
+// 房管操作记录文件名字
+const moderationLogFile = "moderation.jsonl"
+
+// 查看房管操作记录时最多返回的数量
+const moderationLogLimit = 100
+
+// 房管操作记录文件位置
+var moderationLogFileLocation string
+
+// 房管操作记录文件的锁
+var moderationLogMutex sync.Mutex
+
+// 匹配弹幕里的链接
+var linkRegexp = regexp.MustCompile(`(?i)(https?://|www\.|[a-z0-9-]+\.(com|cn|net|org|cc|tv|top|xyz|me|io)\b)`)
+
+// 房管规则，AcFun没有禁言的接口，违反规则的用户会被踢出直播间
+type moderateData struct {
+	Keywords    []string `json:"keywords"`    // 踢出发送包含这些违禁词的弹幕的用户，不区分大小写
+	Regexps     []string `json:"regexps"`     // 踢出发送符合这些正则表达式的弹幕的用户
+	BlockLinks  bool     `json:"blockLinks"`  // 是否踢出发送包含链接的弹幕的用户
+	FloodCount  int      `json:"floodCount"`  // 踢出在floodWindow秒内发送超过该数量弹幕的用户，为0时不检测刷屏
+	FloodWindow float64  `json:"floodWindow"` // 检测刷屏的时间窗口秒数，为0时是10秒
+	AllowUIDs   []int64  `json:"allowUIDs"`   // 不处理这些uid的用户，主播和房管也不会被处理
+}
+
+// 补全房管规则里的nil
+func (m *moderateData) normalize() {
+	if m.Keywords == nil {
+		m.Keywords = []string{}
+	}
+	if m.Regexps == nil {
+		m.Regexps = []string{}
+	}
+	if m.AllowUIDs == nil {
+		m.AllowUIDs = []int64{}
+	}
+}
+
+// 一条房管操作记录
+type moderationEntry struct {
+	Time     int64  `json:"time"`     // 操作的时间，是以毫秒为单位的Unix时间
+	UID      int    `json:"uid"`      // 主播uid
+	Name     string `json:"name"`     // 主播名字
+	LiveID   string `json:"liveID"`   // 直播ID
+	UserID   int64  `json:"userID"`   // 被处理的用户uid
+	Nickname string `json:"nickname"` // 被处理的用户名字
+	Content  string `json:"content"`  // 违反规则的弹幕
+	Rule     string `json:"rule"`     // 违反的规则
+	Action   string `json:"action"`   // 进行的操作
+	DryRun   bool   `json:"dryRun"`   // 是否只记录不操作
+	Result   string `json:"result"`   // 操作的结果
+}
+
+// 按照房管规则处理弹幕，实现danmuWriter，弹幕下载重启时继续使用
+type danmuModerator struct {
+	s        streamer
+	liveID   string
+	dryRun   bool
+	keywords []string
+	regexps  []*regexp.Regexp
+	allow    map[int64]bool
+	recent   map[int64][]int64 // 用户最近发送弹幕的时间，用来检测刷屏
+	handled  map[int64]bool    // 已经处理过的用户
+	ac       *acfundanmu.AcFunLive
+}
+
+// 新建danmuModerator，没有设置规则时返回nil
+func newDanmuModerator(s streamer, info liveInfo) *danmuModerator {
+	rule := s.ModerateRule
+	m := &danmuModerator{
+		s:       s,
+		liveID:  info.LiveID,
+		dryRun:  s.ModerateDryRun,
+		allow:   make(map[int64]bool),
+		recent:  make(map[int64][]int64),
+		handled: make(map[int64]bool),
+	}
+	for _, k := range rule.Keywords {
+		if k != "" {
+			m.keywords = append(m.keywords, strings.ToLower(k))
+		}
+	}
+	for _, r := range rule.Regexps {
+		re, err := regexp.Compile(r)
+		if err != nil {
+			lPrintErrf("%s里%s的moderateRule有错误的正则表达式 %s ：%v", liveFile, s.longID(), r, err)
+			continue
+		}
+		m.regexps = append(m.regexps, re)
+	}
+	if len(m.keywords) == 0 && len(m.regexps) == 0 && !rule.BlockLinks && rule.FloodCount <= 0 {
+		lPrintWarnf("%s没有设置moderateRule，取消在其直播间执行房管规则", s.longID())
+		return nil
+	}
+	if rule.FloodCount > 0 && rule.FloodWindow <= 0 {
+		m.s.ModerateRule.FloodWindow = 10
+	}
+	for _, uid := range rule.AllowUIDs {
+		m.allow[uid] = true
+	}
+	return m
+}
+
+// 检查弹幕是否违反规则，返回违反的规则
+func (m *danmuModerator) check(c *acfundanmu.Comment) string {
+	lower := strings.ToLower(c.Content)
+	for _, k := range m.keywords {
+		if strings.Contains(lower, k) {
+			return "违禁词 " + k
+		}
+	}
+	for _, re := range m.regexps {
+		if re.MatchString(c.Content) {
+			return "正则表达式 " + re.String()
+		}
+	}
+	rule := m.s.ModerateRule
+	if rule.BlockLinks && linkRegexp.MatchString(c.Content) {
+		return "链接"
+	}
+	if rule.FloodCount > 0 {
+		window := int64(rule.FloodWindow * 1000)
+		times := m.recent[c.UserID]
+		i := 0
+		for i < len(times) && c.SendTime-times[i] > window {
+			i++
+		}
+		times = append(times[i:], c.SendTime)
+		m.recent[c.UserID] = times
+		if len(times) > rule.FloodCount {
+			return fmt.Sprintf("刷屏 %g秒内%d条弹幕", rule.FloodWindow, len(times))
+		}
+	}
+	return ""
+}
+
+// 处理一条弹幕
+func (m *danmuModerator) writeDanmu(d acfundanmu.DanmuMessage) error {
+	c, ok := d.(*acfundanmu.Comment)
+	if !ok {
+		return nil
+	}
+	// 不处理主播、房管和白名单里的用户
+	if c.UserID == int64(m.s.UID) || c.ManagerType != acfundanmu.NotManager || m.allow[c.UserID] || m.handled[c.UserID] {
+		return nil
+	}
+	rule := m.check(c)
+	if rule == "" {
+		return nil
+	}
+
+	m.handled[c.UserID] = true
+	delete(m.recent, c.UserID)
+	e := moderationEntry{
+		Time:     time.Now().UnixMilli(),
+		UID:      m.s.UID,
+		Name:     m.s.Name,
+		LiveID:   m.liveID,
+		UserID:   c.UserID,
+		Nickname: c.Nickname,
+		Content:  c.Content,
+		Rule:     rule,
+		Action:   "kick",
+		DryRun:   m.dryRun,
+	}
+	switch {
+	case m.dryRun:
+		e.Result = "dry run，没有踢出"
+	case m.ac == nil:
+		e.Result = "没有连接直播间"
+	default:
+		var err error
+		// 登陆的帐号是主播时用主播的接口踢人
+		if m.ac.GetUserID() == int64(m.s.UID) {
+			err = m.ac.AuthorKick(m.liveID, c.UserID)
+		} else {
+			err = m.ac.ManagerKick(m.liveID, c.UserID)
+		}
+		if err != nil {
+			e.Result = "失败：" + err.Error()
+			// 失败时允许下次再处理
+			delete(m.handled, c.UserID)
+		} else {
+			e.Result = "成功"
+		}
+	}
+
+	lPrintf("%s的直播间：用户%s（%d）的弹幕 %s 违反规则 %s ，踢出结果：%s", m.s.longID(), c.Nickname, c.UserID, c.Content, rule, e.Result)
+	if err := writeModerationLog(e); err != nil {
+		lPrintErrf("写入房管操作记录失败：%v", err)
+	}
+	return nil
+}
+
+// 不需要flush
+func (m *danmuModerator) flush() error {
+	return nil
+}
+
+// 弹幕下载重启时继续使用，所以不做任何事情
+func (m *danmuModerator) close() error {
+	return nil
+}
+
+// 写入一条房管操作记录
+func writeModerationLog(e moderationEntry) error {
+	moderationLogMutex.Lock()
+	defer moderationLogMutex.Unlock()
+	f, err := os.OpenFile(moderationLogFileLocation, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetEscapeHTML(false)
+	if err = enc.Encode(e); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// 读取最近的房管操作记录，uid为0时读取所有主播的记录，结果按时间从新到旧排序
+func readModerationLog(uid int) ([]moderationEntry, error) {
+	moderationLogMutex.Lock()
+	defer moderationLogMutex.Unlock()
+	list := []moderationEntry{}
+	f, err := os.Open(moderationLogFileLocation)
+	if os.IsNotExist(err) {
+		return list, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var e moderationEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("房管操作记录 %s 第%d行的格式错误：%w", moderationLogFileLocation, n, err)
+		}
+		if uid == 0 || e.UID == uid {
+			list = append(list, e)
+			if len(list) > moderationLogLimit {
+				list = list[1:]
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	for i, j := 0, len(list)-1; i < j; i, j = i+1, j-1 {
+		list[i], list[j] = list[j], list[i]
+	}
+	return list, nil
+}
+
+// 获取最近的房管操作记录的JSON
+func moderationLogJSON(uid int) string {
+	list, err := readModerationLog(uid)
+	if err != nil {
+		lPrintErrf("读取房管操作记录失败：%v", err)
+		return ""
+	}
+	data, err := json.MarshalIndent(list, "", "    ")
+	checkErr(err)
+	return string(data)
+}
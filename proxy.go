@@ -0,0 +1,177 @@
+// 代理相关
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/orzogc/acfundanmu"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttpproxy"
+)
+
+// live.json里设置主播不使用代理的值
+const proxyDirect = "direct"
+
+// 连接代理的超时时间
+const proxyTimeout = 10 * time.Second
+
+// 通过代理连接的dial函数，没有设置代理时为nil
+var proxyDial fasthttp.DialFunc
+
+// 检查代理地址，支持http和socks5
+func parseProxy(proxy string) (*url.URL, error) {
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("不支持的代理协议 %s ，只支持http和socks5", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("代理地址 %s 缺少主机名和端口", proxy)
+	}
+	return u, nil
+}
+
+// 根据代理地址获取dial函数
+func newProxyDial(proxy string) (fasthttp.DialFunc, error) {
+	u, err := parseProxy(proxy)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "http" {
+		// fasthttpproxy的格式为 username:password@host:port
+		addr := u.Host
+		if u.User != nil {
+			addr = u.User.String() + "@" + u.Host
+		}
+		return fasthttpproxy.FasthttpHTTPDialerTimeout(addr, proxyTimeout), nil
+	}
+	return fasthttpproxy.FasthttpSocksDialer(proxy), nil
+}
+
+// 根据config.json设置全局代理，需要在发送请求前调用
+func setupProxy() error {
+	if config.Proxy == "" {
+		return nil
+	}
+	dial, err := newProxyDial(config.Proxy)
+	if err != nil {
+		return err
+	}
+	proxyDial = dial
+	defaultClient.Dial = dial
+	lPrintln("通过代理 " + redactProxy(config.Proxy) + " 连接AcFun")
+	// acfundanmu库没有提供设置HTTP客户端的选项，库内部的请求不会通过代理
+	lPrintWarn("acfundanmu库内部的请求（登陆、获取token、直播间信息、直播总结和踢人等）不会通过代理，需要能直接连接AcFun")
+	return nil
+}
+
+// 隐藏代理地址里的密码
+func redactProxy(proxy string) string {
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return proxy
+	}
+	return u.Redacted()
+}
+
+// 通过代理连接弹幕服务器的弹幕客户端，实现acfundanmu.DanmuClient，使用TCP协议
+type proxyDanmuClient struct {
+	conn net.Conn
+}
+
+// 新建proxyDanmuClient
+func (client *proxyDanmuClient) NewDanmuClient() acfundanmu.DanmuClient {
+	return &proxyDanmuClient{}
+}
+
+// 返回acfundanmu.TCPDanmuClientType
+func (client *proxyDanmuClient) Type() acfundanmu.DanmuClientType {
+	return acfundanmu.TCPDanmuClientType
+}
+
+// 通过代理连接弹幕服务器
+func (client *proxyDanmuClient) Dial(address string) error {
+	conn, err := proxyDial(address)
+	if err != nil {
+		client.conn = nil
+		return err
+	}
+	client.conn = conn
+	return nil
+}
+
+// 读数据
+func (client *proxyDanmuClient) Read(p []byte) (n int, err error) {
+	if client.conn == nil {
+		return 0, fmt.Errorf("请先调用 Dial() 连接服务器")
+	}
+	return client.conn.Read(p)
+}
+
+// 写数据
+func (client *proxyDanmuClient) Write(p []byte) (n int, err error) {
+	if client.conn == nil {
+		return 0, fmt.Errorf("请先调用 Dial() 连接服务器")
+	}
+	return client.conn.Write(p)
+}
+
+// 关闭连接
+func (client *proxyDanmuClient) Close(message string) error {
+	if client.conn == nil {
+		return nil
+	}
+	return client.conn.Close()
+}
+
+// 新建acfundanmu.AcFunLive时的选项，设置了代理时弹幕连接会通过代理
+func acOptions(options ...acfundanmu.Option) []acfundanmu.Option {
+	if proxyDial != nil {
+		options = append(options, acfundanmu.SetDanmuClient(&proxyDanmuClient{}))
+	}
+	return options
+}
+
+// 获取下载直播源时使用的代理，live.json里的设置会覆盖config.json的设置，不使用代理时返回空字符串
+func (s *streamer) streamProxy() string {
+	switch s.Proxy {
+	case "":
+		return config.Proxy
+	case proxyDirect:
+		return ""
+	default:
+		return s.Proxy
+	}
+}
+
+// 获取ffmpeg拉取直播源时使用代理的参数，ffmpeg只支持http代理，不支持时返回错误，防止不通过代理直接连接
+func (s *streamer) ffmpegProxyArgs() ([]string, error) {
+	proxy := s.streamProxy()
+	if proxy == "" {
+		return nil, nil
+	}
+	u, err := parseProxy(proxy)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" {
+		return nil, fmt.Errorf("FFmpeg不支持代理 %s ，只支持http代理，如要直接连接请将live.json里的proxy设置为%s", redactProxy(proxy), proxyDirect)
+	}
+	return []string{"-http_proxy", proxy}, nil
+}
+
+// 检查live.json里主播的代理设置
+func (s *streamer) checkProxy() error {
+	if s.Proxy == "" || s.Proxy == proxyDirect {
+		return nil
+	}
+	_, err := parseProxy(s.Proxy)
+	return err
+}
@@ -0,0 +1,227 @@
+// 直播画面和声音质量检测相关
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 质量问题的类型
+const (
+	qualityBlack   = "black"   // 黑屏
+	qualityFreeze  = "freeze"  // 画面静止
+	qualitySilence = "silence" // 无声
+)
+
+// 质量检测的设置数据
+type qualityData struct {
+	BlackDuration   float64 `json:"blackDuration"`   // 黑屏持续超过该秒数时提醒
+	FreezeDuration  float64 `json:"freezeDuration"`  // 画面静止持续超过该秒数时提醒
+	SilenceDuration float64 `json:"silenceDuration"` // 无声持续超过该秒数时提醒
+	SilenceNoise    float64 `json:"silenceNoise"`    // 音量低于该值（dB）时视为无声
+	AlertInterval   float64 `json:"alertInterval"`   // 同一种质量问题两次提醒的最小间隔秒数
+}
+
+// 质量问题出现的时间段，时间是相对于录播开始的秒数
+type qualityRange struct {
+	Type  string  `json:"type"`  // 质量问题的类型，有black、freeze和silence三种
+	Start float64 `json:"start"` // 开始时间
+	End   float64 `json:"end"`   // 结束时间，为-1时说明没有检测到恢复
+}
+
+var (
+	blackFrameRe   = regexp.MustCompile(`pblack:\d+ pts:\S+ t:(\S+)`)
+	blackRe        = regexp.MustCompile(`black_start:(\S+) black_end:(\S+)`)
+	freezeStartRe  = regexp.MustCompile(`freeze_start: (\S+)`)
+	freezeEndRe    = regexp.MustCompile(`freeze_end: (\S+)`)
+	silenceStartRe = regexp.MustCompile(`silence_start: (\S+)`)
+	silenceEndRe   = regexp.MustCompile(`silence_end: (\S+)`)
+)
+
+// 记录质量问题的时间段
+type qualityRecorder struct {
+	sync.Mutex
+	ranges  []qualityRange
+	open    map[string]int       // 还没有结束的质量问题在ranges里的index
+	alerted map[string]time.Time // 每种质量问题上一次提醒的时间
+}
+
+// 质量问题开始
+func (q *qualityRecorder) start(t string, start float64) {
+	q.Lock()
+	defer q.Unlock()
+	q.open[t] = len(q.ranges)
+	q.ranges = append(q.ranges, qualityRange{Type: t, Start: start, End: -1})
+}
+
+// 质量问题结束
+func (q *qualityRecorder) end(t string, end float64) {
+	q.Lock()
+	defer q.Unlock()
+	if i, ok := q.open[t]; ok {
+		q.ranges[i].End = end
+		delete(q.open, t)
+	}
+}
+
+// 添加完整的质量问题时间段，已经开始的质量问题会被更新
+func (q *qualityRecorder) add(t string, start, end float64) {
+	q.Lock()
+	defer q.Unlock()
+	if i, ok := q.open[t]; ok {
+		q.ranges[i].Start = start
+		q.ranges[i].End = end
+		delete(q.open, t)
+		return
+	}
+	q.ranges = append(q.ranges, qualityRange{Type: t, Start: start, End: end})
+}
+
+// 取消还没有结束的质量问题，用于检测重启时
+func (q *qualityRecorder) closeAll() {
+	q.Lock()
+	defer q.Unlock()
+	for t := range q.open {
+		delete(q.open, t)
+	}
+}
+
+// 检测直播的黑屏、画面静止和无声，recordStart为录播开始的时间，ctx结束时返回检测到的质量问题
+func (s streamer) checkQuality(ctx context.Context, info liveInfo, recordStart time.Time) []qualityRange {
+	q := &qualityRecorder{open: make(map[string]int), alerted: make(map[string]time.Time)}
+
+	ffmpegFile := getFFmpeg()
+	if ffmpegFile == "" {
+		return nil
+	}
+	// 使用码率最低的直播源进行检测
+	if len(info.StreamList) == 0 {
+		lPrintErrf("没有%s的直播源，取消质量检测", s.longID())
+		return nil
+	}
+	url := info.StreamList[0].URL
+
+	lPrintln("开始检测" + s.longID() + "的直播画面和声音")
+	var b backoff
+	for restart := false; ; restart = true {
+		// 直播源的地址会过期，重启检测时重新获取
+		if restart {
+			if sInfo, err := s.getStreamInfo(); err == nil && len(sInfo.StreamList) != 0 {
+				url = sInfo.StreamList[0].URL
+			} else {
+				lPrintWarnf("重新获取%s的直播源失败，继续使用之前的直播源", s.longID())
+			}
+		}
+		checkStart := time.Now()
+		offset := checkStart.Sub(recordStart).Seconds()
+		s.runQualityCheck(ctx, ffmpegFile, url, offset, q)
+		q.closeAll()
+
+		if ctx.Err() == nil {
+			// 检测运行了一段时间才结束的话不算连续失败
+			d := b.next(time.Since(checkStart) >= time.Minute, seconds(config.Interval.Retry))
+			lPrintWarnf("检测%s的直播画面和声音意外结束，%.0f秒后尝试重启检测", s.longID(), d.Seconds())
+			if sleepCtx(ctx, d) {
+				continue
+			}
+		}
+		lPrintln("停止检测" + s.longID() + "的直播画面和声音")
+		q.Lock()
+		defer q.Unlock()
+		return q.ranges
+	}
+}
+
+// 运行ffmpeg进行一次质量检测，offset为本次检测开始时相对于录播开始的秒数
+func (s streamer) runQualityCheck(ctx context.Context, ffmpegFile, url string, offset float64, q *qualityRecorder) {
+	defer func() {
+		if err := recover(); err != nil {
+			lPrintErr("Recovering from panic in runQualityCheck(), the error is:", err)
+		}
+	}()
+
+	cfg := config.Quality
+	// blackdetect只在黑屏结束时输出，用blackframe输出每一帧黑屏来及时提醒，blackdetect用来记录黑屏的时间段
+	vf := fmt.Sprintf("fps=2,scale=160:-2,blackframe=amount=98,blackdetect=d=%g,freezedetect=d=%g", cfg.BlackDuration, cfg.FreezeDuration)
+	af := fmt.Sprintf("aresample=8000,silencedetect=n=%gdB:d=%g", cfg.SilenceNoise, cfg.SilenceDuration)
+	args := []string{"-hide_banner", "-nostats", "-nostdin", "-rw_timeout", "20000000"}
+	proxyArgs, err := s.ffmpegProxyArgs()
+	checkErr(err)
+	args = append(args, proxyArgs...)
+	args = append(args, "-i", url, "-vf", vf, "-af", af, "-f", "null", "-")
+	cmd := exec.CommandContext(ctx, ffmpegFile, args...)
+	hideCmdWindow(cmd)
+
+	stderr, err := cmd.StderrPipe()
+	checkErr(err)
+	err = cmd.Start()
+	checkErr(err)
+
+	parse := func(v string) float64 {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return 0
+		}
+		return f + offset
+	}
+
+	// 连续黑屏帧的开始时间和上一帧黑屏的时间，fps为2，间隔超过1秒说明中间有不是黑屏的帧
+	blackStart, lastBlack := -1.0, -1.0
+	blackAlerted := false
+	scanner := bufio.NewScanner(stderr)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case blackFrameRe.MatchString(line):
+			t := parse(blackFrameRe.FindStringSubmatch(line)[1])
+			if lastBlack < 0 || t-lastBlack > 1 {
+				blackStart = t
+				blackAlerted = false
+			}
+			lastBlack = t
+			if !blackAlerted && t-blackStart >= cfg.BlackDuration {
+				blackAlerted = true
+				q.start(qualityBlack, blackStart)
+				s.qualityAlert(q, qualityBlack, fmt.Sprintf("%s的直播已经黑屏超过%g秒", s.Name, cfg.BlackDuration))
+			}
+		case blackRe.MatchString(line):
+			m := blackRe.FindStringSubmatch(line)
+			q.add(qualityBlack, parse(m[1]), parse(m[2]))
+			lPrintln(s.longID() + "的直播画面黑屏结束")
+		case freezeStartRe.MatchString(line):
+			q.start(qualityFreeze, parse(freezeStartRe.FindStringSubmatch(line)[1]))
+			s.qualityAlert(q, qualityFreeze, fmt.Sprintf("%s的直播画面已经静止超过%g秒", s.Name, config.Quality.FreezeDuration))
+		case freezeEndRe.MatchString(line):
+			q.end(qualityFreeze, parse(freezeEndRe.FindStringSubmatch(line)[1]))
+			lPrintln(s.longID() + "的直播画面恢复正常")
+		case silenceStartRe.MatchString(line):
+			q.start(qualitySilence, parse(silenceStartRe.FindStringSubmatch(line)[1]))
+			s.qualityAlert(q, qualitySilence, fmt.Sprintf("%s的直播已经无声超过%g秒", s.Name, config.Quality.SilenceDuration))
+		case silenceEndRe.MatchString(line):
+			q.end(qualitySilence, parse(silenceEndRe.FindStringSubmatch(line)[1]))
+			lPrintln(s.longID() + "的直播声音恢复正常")
+		}
+	}
+
+	_ = cmd.Wait()
+}
+
+// 发送质量问题的提醒，同一种质量问题在设置的alertInterval内只发送一次通知
+func (s streamer) qualityAlert(q *qualityRecorder, t, msg string) {
+	lPrintWarn(msg)
+	q.Lock()
+	if time.Since(q.alerted[t]) < seconds(config.Quality.AlertInterval) {
+		q.Unlock()
+		return
+	}
+	q.alerted[t] = time.Now()
+	q.Unlock()
+	desktopNotify(msg)
+	s.sendMirai(msg, false)
+}
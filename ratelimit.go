@@ -0,0 +1,117 @@
+// 请求间隔、失败退避和请求限速相关
+package main
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// 各种循环的间隔设置
+type intervalData struct {
+	FetchRooms float64 `json:"fetchRooms"` // 获取AcFun直播间列表的间隔秒数
+	Medals     float64 `json:"medals"`     // 获取守护徽章列表（autoKeepOnline）的间隔秒数
+	Retry      float64 `json:"retry"`      // 请求失败后第一次重试前等待的秒数，之后每次失败加倍
+	MaxBackoff float64 `json:"maxBackoff"` // 连续失败时等待的最大秒数
+}
+
+// 请求限速设置
+type rateLimitData struct {
+	Rate  float64 `json:"rate"`  // 所有AcFun接口请求平均每秒最多的数量，为0时不限速
+	Burst int     `json:"burst"` // 短时间内最多连续请求的数量
+}
+
+// 将秒数转换为time.Duration
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// 失败时按指数退避加上随机抖动，成功时恢复正常间隔
+type backoff struct {
+	failures int
+}
+
+// 获取下一次循环前等待的时间，ok为本次是否成功，interval为正常的间隔
+func (b *backoff) next(ok bool, interval time.Duration) time.Duration {
+	if ok {
+		b.failures = 0
+		return interval
+	}
+	b.failures++
+	return backoffDelay(b.failures)
+}
+
+// 获取第n次连续失败后等待的时间，在[d/2, d)之间随机，防止多个请求同时重试
+func backoffDelay(n int) time.Duration {
+	d := seconds(config.Interval.Retry)
+	max := seconds(config.Interval.MaxBackoff)
+	for i := 1; i < n && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	if d <= 1 {
+		return d
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)))
+}
+
+// 等待d，ctx结束时返回false
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// 令牌桶，所有httpClient.doRequest共用
+type tokenBucket struct {
+	sync.Mutex
+	tokens float64   // 现在的令牌数量，为负数时表示已经预约的令牌
+	last   time.Time // 上一次补充令牌的时间
+}
+
+// 所有AcFun接口请求共用的限速器
+var apiLimiter tokenBucket
+
+// 等待直到可以发送请求
+func (b *tokenBucket) wait() {
+	b.Lock()
+	rate := config.RateLimit.Rate
+	if rate <= 0 {
+		b.Unlock()
+		return
+	}
+	burst := float64(config.RateLimit.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+
+	now := time.Now()
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * rate
+		if b.tokens > burst {
+			b.tokens = burst
+		}
+	}
+	b.last = now
+	// 预约一个令牌，不够时等待补充
+	b.tokens--
+	var d time.Duration
+	if b.tokens < 0 {
+		d = seconds(-b.tokens / rate)
+	}
+	b.Unlock()
+
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
@@ -2,17 +2,84 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
 const ffmpegNotExist = "没有找到FFmpeg，停止下载直播视频"
 
+// 等待获取录播实际开始的时间的最长时间
+const recordStartTimeout = time.Minute
+
+// 根据ffmpeg的-progress输出获取录播实际开始的时间，是以纳秒为单位的Unix时间，会发送到每个recordStart
+func watchRecordStart(r io.Reader, recordStart ...chan<- int64) {
+	sent := false
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// 发送后也要继续读取，防止ffmpeg阻塞
+		if sent {
+			continue
+		}
+		// 旧版本的ffmpeg只有out_time_ms，但其单位也是微秒
+		line := scanner.Text()
+		v, ok := strings.CutPrefix(line, "out_time_us=")
+		if !ok {
+			v, ok = strings.CutPrefix(line, "out_time_ms=")
+		}
+		if !ok {
+			continue
+		}
+		if us, err := strconv.ParseInt(v, 10, 64); err == nil && us > 0 {
+			// 减去已经下载的视频的时长就是第一帧的时间
+			t := time.Now().UnixNano() - us*1e3
+			for _, ch := range recordStart {
+				ch <- t
+			}
+			sent = true
+		}
+	}
+}
+
+// 录播的元数据，保存在和录播文件同名的json文件里
+type recordMeta struct {
+	UID        int            `json:"uid"`        // 主播uid
+	Name       string         `json:"name"`       // 主播名字
+	LiveID     string         `json:"liveID"`     // 直播ID
+	Title      string         `json:"title"`      // 直播间标题
+	RecordFile string         `json:"recordFile"` // 录播文件名
+	StartTime  int64          `json:"startTime"`  // 录播开始的时间，是以毫秒为单位的Unix时间
+	EndTime    int64          `json:"endTime"`    // 录播结束的时间，是以毫秒为单位的Unix时间
+	Quality    []qualityRange `json:"quality"`    // 检测到的黑屏、画面静止和无声的时间段
+}
+
+// 保存录播的元数据，返回元数据文件的路径
+func (m *recordMeta) save(recordFile string) string {
+	metaFile := strings.TrimSuffix(recordFile, filepath.Ext(recordFile)) + ".meta.json"
+	if m.Quality == nil {
+		m.Quality = []qualityRange{}
+	}
+	data, err := json.MarshalIndent(m, "", "    ")
+	if err != nil {
+		lPrintErrf("生成录播 %s 的元数据失败：%v", recordFile, err)
+		return ""
+	}
+	if err = os.WriteFile(metaFile, data, 0644); err != nil {
+		lPrintErrf("保存录播 %s 的元数据失败：%v", recordFile, err)
+		return ""
+	}
+	return metaFile
+}
+
 // 临时下载指定主播的直播视频
 func startRec(uid int, danmu bool) bool {
 	var name string
@@ -111,6 +178,18 @@ func (s streamer) recordLive(danmu bool) {
 		return
 	}
 
+	// 不能通过设置的代理下载时不下载
+	proxyArgs, err := s.ffmpegProxyArgs()
+	if err != nil {
+		msg := "无法通过代理下载%s的直播视频：%v"
+		lPrintErrf(msg, s.longID(), err)
+		if s.Notify.NotifyRecord {
+			desktopNotify("无法通过代理下载" + s.Name + "的直播视频")
+			s.sendMirai(fmt.Sprintf(msg, s.Name, err), false)
+		}
+		return
+	}
+
 	// 获取直播源
 	info, err := s.getLiveInfo()
 	if err != nil {
@@ -143,6 +222,7 @@ func (s streamer) recordLive(danmu bool) {
 	// 想要输出其他视频格式可以修改config.json里的Output
 	recordFile = recordFile + "." + config.Output
 	info.recordFile = recordFile
+	historyAddFiles(info.LiveID, true, false, s.movedFile(recordFile))
 
 	lPrintln("开始下载" + s.longID() + "的直播视频")
 	lPrintln("本次下载的视频文件保存在" + recordFile)
@@ -162,11 +242,10 @@ func (s streamer) recordLive(danmu bool) {
 	// 运行ffmpeg下载直播视频，不用mainCtx是为了能正常退出
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
-	cmd := exec.CommandContext(ctx, ffmpegFile,
-		"-rw_timeout", "20000000",
-		"-timeout", "20000000",
-		"-i", info.streamURL,
-		"-c", "copy", recordFile)
+	args := []string{"-progress", "pipe:1", "-rw_timeout", "20000000", "-timeout", "20000000"}
+	args = append(args, proxyArgs...)
+	args = append(args, "-i", info.streamURL, "-c", "copy", recordFile)
+	cmd := exec.CommandContext(ctx, ffmpegFile, args...)
 	hideCmdWindow(cmd)
 
 	stdin, err := cmd.StdinPipe()
@@ -190,19 +269,75 @@ func (s streamer) recordLive(danmu bool) {
 		lPrintln("按q键退出下载直播视频")
 	}
 
+	// 获取录播实际开始的时间，用来对齐弹幕和质量检测的时间
+	danmuStart := make(chan int64, 1)
+	recordStart := make(chan int64, 1)
+	progress, progressWriter := io.Pipe()
+	cmd.Stdout = progressWriter
+	go watchRecordStart(progress, danmuStart, recordStart)
+
 	// 下载弹幕
+	var danmuDone chan struct{}
 	if danmu {
-		go s.initDanmu(ctx, info.LiveID, filename)
+		danmuDone = make(chan struct{})
+		go func() {
+			defer close(danmuDone)
+			s.initDanmu(ctx, info.LiveID, filename, danmuStart)
+		}()
+	}
+
+	// 检测黑屏、画面静止和无声，问题的时间以录播实际开始的时间为准
+	qualityStart := time.Now()
+	var qualityCh chan []qualityRange
+	if s.QualityCheck {
+		qualityCh = make(chan []qualityRange, 1)
+		go func() {
+			select {
+			case t := <-recordStart:
+				qualityStart = time.Unix(0, t)
+			case <-time.After(recordStartTimeout):
+				lPrintWarnf("没有获取到%s的直播视频实际开始的时间，检测到的质量问题的时间可能和录播对不上", s.longID())
+			case <-ctx.Done():
+			}
+			qualityCh <- s.checkQuality(ctx, info, qualityStart)
+		}()
 	}
 
 	err = cmd.Run()
+	_ = progressWriter.Close()
 	if err != nil {
 		lPrintErrf("下载%s的直播视频出现错误，尝试重启下载：%v", s.longID(), err)
 	}
-	defer s.moveFile(recordFile)
 
-	// 取消弹幕下载
+	// 取消弹幕下载和质量检测
 	cancel()
+	if (s.BurnDanmu || s.Highlight) && s.Danmu && danmuDone != nil {
+		// 压制弹幕和剪辑精彩片段后再移动录播文件
+		if *isListen {
+			go s.processRecord(recordFile, danmuDone)
+		} else {
+			s.processRecord(recordFile, danmuDone)
+		}
+	} else {
+		defer s.moveFile(recordFile)
+	}
+	if qualityCh != nil {
+		// 收到检测结果后qualityStart才是录播实际开始的时间
+		quality := <-qualityCh
+		meta := recordMeta{
+			UID:        s.UID,
+			Name:       s.Name,
+			LiveID:     info.LiveID,
+			Title:      title,
+			RecordFile: filepath.Base(recordFile),
+			StartTime:  qualityStart.UnixMilli(),
+			EndTime:    time.Now().UnixMilli(),
+			Quality:    quality,
+		}
+		if metaFile := meta.save(recordFile); metaFile != "" {
+			defer s.moveFile(metaFile)
+		}
+	}
 	time.Sleep(10 * time.Second)
 
 	if s.isLiveOnByPage() {
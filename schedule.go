@@ -0,0 +1,362 @@
+// 直播时间表相关
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// 直播时间表相关设置
+type scheduleData struct {
+	Weeks      int     `json:"weeks"`      // 根据最近多少周的直播历史统计直播时间表
+	Regular    float64 `json:"regular"`    // 某个星期几开播的比例大于等于该值时视为固定的直播时段，在0到1之间
+	WarnMissed bool    `json:"warnMissed"` // 主播在固定的直播时段没有开播时是否提醒
+	Grace      float64 `json:"grace"`      // 超过通常开播时间多少分钟还没有开播时提醒
+}
+
+// 固定的直播时段最少需要的开播天数
+const scheduleMinDays = 3
+
+// 检查固定的直播时段有没有开播的间隔
+const scheduleCheckInterval = time.Minute
+
+// 星期几的名字
+var weekdayNames = [7]string{"周日", "周一", "周二", "周三", "周四", "周五", "周六"}
+
+// 某个星期几的直播时间
+type weekdaySchedule struct {
+	Weekday     int     `json:"weekday"`     // 星期几，0为星期日
+	Name        string  `json:"name"`        // 星期几的名字
+	Days        int     `json:"days"`        // 统计范围内这个星期几的天数
+	LiveDays    int     `json:"liveDays"`    // 其中有开播的天数
+	Probability float64 `json:"probability"` // 开播的概率
+	UsualStart  string  `json:"usualStart"`  // 通常开播的时间，格式为15:04，没有开播时为空
+	AvgDuration float64 `json:"avgDuration"` // 平均直播秒数
+	Regular     bool    `json:"regular"`     // 是否固定的直播时段
+	startMinute int     // 通常开播的时间是当天的第几分钟
+}
+
+// 主播的直播时间表
+type liveSchedule struct {
+	UID         int                `json:"uid"`         // 主播uid
+	Name        string             `json:"name"`        // 主播名字
+	From        int64              `json:"from"`        // 统计开始的时间，是以毫秒为单位的Unix时间
+	To          int64              `json:"to"`          // 统计结束的时间，是以毫秒为单位的Unix时间
+	Sessions    int                `json:"sessions"`    // 统计的直播数量
+	AvgDuration float64            `json:"avgDuration"` // 平均直播秒数
+	UsualStart  string             `json:"usualStart"`  // 通常开播的时间，格式为15:04，没有开播时为空
+	Weekdays    [7]weekdaySchedule `json:"weekdays"`    // 每个星期几的直播时间，0为星期日
+	Hourly      [7][24]float64     `json:"hourly"`      // 每个星期几每个小时在直播的概率，第一维0为星期日，时间为本地时间
+	sessions    []liveSession      // 统计的直播，按时间从新到旧排序
+}
+
+// 获取t所在那天的零点
+func startOfDay(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+// 计算一天里的时间（分钟）的平均值，23:50和00:10的平均值为00:00
+func meanMinute(minutes []int) int {
+	var x, y float64
+	for _, m := range minutes {
+		a := float64(m) / (24 * 60) * 2 * math.Pi
+		x += math.Cos(a)
+		y += math.Sin(a)
+	}
+	a := math.Atan2(y, x)
+	if a < 0 {
+		a += 2 * math.Pi
+	}
+	return int(math.Round(a/(2*math.Pi)*24*60)) % (24 * 60)
+}
+
+// 将一天里的分钟转换为15:04的格式
+func formatMinute(m int) string {
+	return fmt.Sprintf("%02d:%02d", m/60, m%60)
+}
+
+// 根据最近的直播历史统计主播的直播时间表
+func computeSchedule(uid int, now time.Time) (*liveSchedule, error) {
+	from := startOfDay(now).AddDate(0, 0, -7*config.Schedule.Weeks)
+	list, err := historyRange(uid, from.UnixMilli(), now.UnixMilli(), 0)
+	if err != nil {
+		return nil, err
+	}
+	// 只统计有直播历史之后的时间，避免刚开始记录时概率偏低
+	if len(list) > 0 {
+		if first := startOfDay(time.UnixMilli(list[len(list)-1].StartTime)); first.After(from) {
+			from = first
+		}
+	}
+
+	sch := &liveSchedule{UID: uid, From: from.UnixMilli(), To: now.UnixMilli(), Sessions: len(list), sessions: list}
+	if len(list) > 0 && list[0].Name != "" {
+		sch.Name = list[0].Name
+	} else {
+		sch.Name = getName(uid)
+	}
+
+	// 每个小时是否在直播
+	hours := int(now.Sub(from)/time.Hour) + 1
+	live := make([]bool, hours)
+	var allStarts []int
+	var starts [7][]int
+	var durations [7]float64
+	liveDays := make(map[string]bool)
+	var total float64
+	for _, s := range list {
+		start := time.UnixMilli(s.StartTime)
+		end := now
+		if s.EndTime != 0 {
+			end = time.UnixMilli(s.EndTime)
+		}
+		for h := int(start.Sub(from) / time.Hour); h < hours && from.Add(time.Duration(h)*time.Hour).Before(end); h++ {
+			if h >= 0 {
+				live[h] = true
+			}
+		}
+
+		wd := start.Weekday()
+		m := start.Hour()*60 + start.Minute()
+		allStarts = append(allStarts, m)
+		starts[wd] = append(starts[wd], m)
+		durations[wd] += s.Duration
+		total += s.Duration
+		liveDays[start.Format("2006-01-02")] = true
+	}
+
+	var slots [7][24]int
+	for h := 0; h < hours; h++ {
+		t := from.Add(time.Duration(h) * time.Hour)
+		slots[t.Weekday()][t.Hour()]++
+		if live[h] {
+			sch.Hourly[t.Weekday()][t.Hour()]++
+		}
+	}
+	for wd := range sch.Hourly {
+		for h := range sch.Hourly[wd] {
+			if slots[wd][h] != 0 {
+				sch.Hourly[wd][h] /= float64(slots[wd][h])
+			}
+		}
+	}
+
+	for wd := range sch.Weekdays {
+		sch.Weekdays[wd].Weekday = wd
+		sch.Weekdays[wd].Name = weekdayNames[wd]
+	}
+	today := startOfDay(now)
+	for day := from; day.Before(now); day = day.AddDate(0, 0, 1) {
+		w := &sch.Weekdays[day.Weekday()]
+		isLive := liveDays[day.Format("2006-01-02")]
+		// 今天还没开播时，只有超过通常开播时间加上宽限时间后才统计，避免每天早上概率偏低
+		if day.Equal(today) && !isLive {
+			wd := starts[day.Weekday()]
+			if len(wd) == 0 {
+				continue
+			}
+			expected := today.Add(time.Duration(meanMinute(wd)) * time.Minute).Add(seconds(config.Schedule.Grace * 60))
+			if now.Before(expected) {
+				continue
+			}
+		}
+		w.Days++
+		if isLive {
+			w.LiveDays++
+		}
+	}
+	for wd := range sch.Weekdays {
+		w := &sch.Weekdays[wd]
+		if w.Days != 0 {
+			w.Probability = float64(w.LiveDays) / float64(w.Days)
+		}
+		if len(starts[wd]) != 0 {
+			w.startMinute = meanMinute(starts[wd])
+			w.UsualStart = formatMinute(w.startMinute)
+			w.AvgDuration = durations[wd] / float64(len(starts[wd]))
+		}
+		w.Regular = w.LiveDays >= scheduleMinDays && w.Probability >= config.Schedule.Regular
+	}
+
+	if len(list) != 0 {
+		sch.AvgDuration = total / float64(len(list))
+		sch.UsualStart = formatMinute(meanMinute(allStarts))
+	}
+
+	return sch, nil
+}
+
+// 获取指定主播的直播时间表的JSON
+func scheduleJSON(uid int) string {
+	sch, err := computeSchedule(uid, time.Now())
+	if err != nil {
+		lPrintErrf("统计%s的直播时间表失败：%v", longID(uid), err)
+		return ""
+	}
+	data, err := json.MarshalIndent(sch, "", "    ")
+	checkErr(err)
+	return string(data)
+}
+
+// 转义iCalendar的文本
+func icalEscape(text string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace(text)
+}
+
+// iCalendar的UTC时间
+func icalTime(t time.Time) string {
+	return t.UTC().Format("20060102T150405Z")
+}
+
+// 写入iCalendar的一行，每行最多75字节，超过时折行
+func icalLine(b *strings.Builder, line string) {
+	for len(line) > 75 {
+		i := 75
+		// 不拆开UTF-8字符
+		for i > 0 && line[i]&0xC0 == 0x80 {
+			i--
+		}
+		b.WriteString(line[:i] + "\r\n")
+		line = " " + line[i:]
+	}
+	b.WriteString(line + "\r\n")
+}
+
+// 获取指定主播的直播时间表的iCalendar，包括固定直播时段的每周重复事件和最近的直播
+func scheduleICal(uid int) string {
+	now := time.Now()
+	sch, err := computeSchedule(uid, now)
+	if err != nil {
+		lPrintErrf("统计%s的直播时间表失败：%v", longID(uid), err)
+		return ""
+	}
+
+	var b strings.Builder
+	stamp := icalTime(now)
+	icalLine(&b, "BEGIN:VCALENDAR")
+	icalLine(&b, "VERSION:2.0")
+	icalLine(&b, "PRODID:-//orzogc//acfunlive//ZH")
+	icalLine(&b, "CALSCALE:GREGORIAN")
+	icalLine(&b, "X-WR-CALNAME:"+icalEscape(sch.Name+"的直播时间表"))
+
+	// 固定的直播时段，由于使用UTC时间，夏令时切换后时间会相差一小时
+	today := startOfDay(now)
+	for _, w := range sch.Weekdays {
+		if !w.Regular {
+			continue
+		}
+		days := (w.Weekday - int(now.Weekday()) + 7) % 7
+		start := today.AddDate(0, 0, days).Add(time.Duration(w.startMinute) * time.Minute)
+		end := start.Add(seconds(w.AvgDuration))
+		icalLine(&b, "BEGIN:VEVENT")
+		icalLine(&b, fmt.Sprintf("UID:acfunlive-schedule-%d-%d", uid, w.Weekday))
+		icalLine(&b, "DTSTAMP:"+stamp)
+		icalLine(&b, "DTSTART:"+icalTime(start))
+		icalLine(&b, "DTEND:"+icalTime(end))
+		icalLine(&b, "RRULE:FREQ=WEEKLY")
+		icalLine(&b, "SUMMARY:"+icalEscape(sch.Name+"的直播（预计）"))
+		icalLine(&b, "DESCRIPTION:"+icalEscape(fmt.Sprintf("%s通常在%s开播，开播概率%.0f%%", w.Name, w.UsualStart, w.Probability*100)))
+		icalLine(&b, "URL:"+getURL(uid))
+		icalLine(&b, "END:VEVENT")
+	}
+
+	// 最近的直播
+	for _, s := range sch.sessions {
+		end := now
+		if s.EndTime != 0 {
+			end = time.UnixMilli(s.EndTime)
+		}
+		summary := sch.Name + "的直播"
+		if len(s.Titles) != 0 {
+			summary = sch.Name + "：" + s.Titles[len(s.Titles)-1]
+		}
+		icalLine(&b, "BEGIN:VEVENT")
+		icalLine(&b, "UID:acfunlive-"+s.LiveID)
+		icalLine(&b, "DTSTAMP:"+stamp)
+		icalLine(&b, "DTSTART:"+icalTime(time.UnixMilli(s.StartTime)))
+		icalLine(&b, "DTEND:"+icalTime(end))
+		icalLine(&b, "SUMMARY:"+icalEscape(summary))
+		icalLine(&b, "URL:"+getURL(uid))
+		icalLine(&b, "END:VEVENT")
+	}
+
+	icalLine(&b, "END:VCALENDAR")
+	return b.String()
+}
+
+// 检查设置里的主播在固定的直播时段有没有开播
+func cycleSchedule(ctx context.Context) {
+	defer func() {
+		if err := recover(); err != nil {
+			lPrintErr("Recovering from panic in cycleSchedule(), the error is:", err)
+			lPrintErr("检查固定直播时段出现错误，尝试重启检查")
+			time.Sleep(2 * time.Second)
+			go cycleSchedule(ctx)
+		}
+	}()
+
+	// 每天每个主播只统计一次直播时间表和提醒一次
+	type cached struct {
+		day string
+		sch *liveSchedule
+	}
+	schedules := make(map[int]cached)
+	warned := make(map[int]string)
+
+	for {
+		now := time.Now()
+		day := now.Format("2006-01-02")
+		for _, s := range getStreamers() {
+			if warned[s.UID] == day || s.isLiveOn() {
+				continue
+			}
+			c, ok := schedules[s.UID]
+			if !ok || c.day != day {
+				sch, err := computeSchedule(s.UID, now)
+				if err != nil {
+					lPrintErrf("统计%s的直播时间表失败：%v", s.longID(), err)
+					continue
+				}
+				c = cached{day: day, sch: sch}
+				schedules[s.UID] = c
+			}
+
+			w := c.sch.Weekdays[now.Weekday()]
+			if !w.Regular {
+				continue
+			}
+			expected := startOfDay(now).Add(time.Duration(w.startMinute) * time.Minute)
+			grace := seconds(config.Schedule.Grace * 60)
+			// 只在通常开播时间加上宽限时间之后、通常的直播时长之内提醒，避免程序晚启动时误报
+			if now.Before(expected.Add(grace)) || now.After(expected.Add(grace).Add(seconds(w.AvgDuration))) {
+				continue
+			}
+			// 通常开播时间前后已经开播过
+			list, err := historyRange(s.UID, expected.Add(-12*time.Hour).UnixMilli(), now.UnixMilli(), 1)
+			if err != nil {
+				lPrintErrf("读取%s的直播历史失败：%v", s.longID(), err)
+				continue
+			}
+			if len(list) != 0 {
+				continue
+			}
+
+			warned[s.UID] = day
+			msg := fmt.Sprintf("%s通常在%s%s左右开播，但现在还没有开播", s.Name, w.Name, w.UsualStart)
+			lPrintWarn(msg)
+			if s.Notify.NotifyOn {
+				desktopNotify(msg)
+				s.sendMirai(msg, true)
+			}
+		}
+
+		if !sleepCtx(ctx, scheduleCheckInterval) {
+			return
+		}
+	}
+}
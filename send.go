@@ -0,0 +1,98 @@
+// 发送弹幕相关
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/orzogc/acfundanmu"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fastjson"
+)
+
+// 发送弹幕的接口
+const sendCommentURL = "%s/rest/zt/live/web/audience/action/comment?subBiz=mainApp&kpn=ACFUN_APP&kpf=PC_WEB&userId=%d&did=%s&acfun.midground.api_st=%s"
+
+// 弹幕内容的最大字数
+const maxCommentLength = 50
+
+// 解析发送弹幕的响应
+var sendCommentPool fastjson.ParserPool
+
+// 用登陆的AcFun帐号发送弹幕到指定主播的直播间
+func sendComment(uid int, content string) (e error) {
+	defer func() {
+		if err := recover(); err != nil {
+			e = fmt.Errorf("%v", err)
+		}
+	}()
+
+	content = strings.TrimSpace(content)
+	if content == "" {
+		return fmt.Errorf("弹幕内容不能为空")
+	}
+	if utf8.RuneCountInString(content) > maxCommentLength {
+		return fmt.Errorf("弹幕内容不能超过%d个字", maxCommentLength)
+	}
+	if config.Endpoints.Mock {
+		return fmt.Errorf("模拟AcFun服务器不支持发送弹幕")
+	}
+	if !is_login_acfun() {
+		return fmt.Errorf("没有登陆AcFun帐号，请先在%s里设置AcFun帐号和密码", configFile)
+	}
+	liveID := getLiveID(uid)
+	if liveID == "" {
+		return fmt.Errorf("%s不在直播", longID(uid))
+	}
+
+	ac, err := acfundanmu.NewAcFunLive(acOptions(acfundanmu.SetLiverUID(int64(uid)), acfundanmu.SetCookies(acfun_cookies()))...)
+	checkErr(err)
+	token := ac.GetTokenInfo()
+
+	form := fasthttp.AcquireArgs()
+	defer fasthttp.ReleaseArgs(form)
+	form.Set("visitorId", strconv.FormatInt(token.UserID, 10))
+	form.Set("liveId", liveID)
+	form.Set("content", content)
+	client := &httpClient{
+		url:         fmt.Sprintf(sendCommentURL, config.Endpoints.Zt, token.UserID, token.DeviceID, token.ServiceToken),
+		body:        form.QueryString(),
+		method:      fasthttp.MethodPost,
+		cookies:     token.Cookies,
+		contentType: "application/x-www-form-urlencoded",
+		referer:     getURL(uid),
+	}
+	resp, err := client.doRequest()
+	checkErr(err)
+	defer fasthttp.ReleaseResponse(resp)
+	body := getBody(resp)
+
+	p := sendCommentPool.Get()
+	defer sendCommentPool.Put(p)
+	v, err := p.ParseBytes(body)
+	checkErr(err)
+	if v.GetInt("result") != 1 {
+		if msg := string(v.GetStringBytes("error_msg")); msg != "" {
+			return fmt.Errorf("AcFun返回错误：%s", msg)
+		}
+		return fmt.Errorf("响应为 %s", string(body))
+	}
+
+	return nil
+}
+
+// 发送弹幕到指定主播的直播间，成功时返回true，失败时返回失败原因
+func sendDanmu(uid int, content string) string {
+	if err := sendComment(uid, content); err != nil {
+		msg := fmt.Sprintf("发送弹幕到%s的直播间失败：%v", longID(uid), err)
+		lPrintErr(msg)
+		data, err := json.Marshal(msg)
+		checkErr(err)
+		return string(data)
+	}
+	lPrintf("成功发送弹幕到%s的直播间：%s", longID(uid), content)
+	return boolStr(true)
+}
@@ -0,0 +1,343 @@
+// 直播弹幕统计相关
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/orzogc/acfundanmu"
+)
+
+// 统计报告里最多列出的发送者和高峰时刻的数量
+const (
+	statsTopSenders = 10
+	statsPeaks      = 3
+)
+
+// 发送弹幕的用户
+type senderStats struct {
+	UserID   int64  `json:"userID"`   // 用户uid
+	Nickname string `json:"nickname"` // 用户名字
+	Comments int    `json:"comments"` // 发送的弹幕数量
+}
+
+// 同一种礼物的统计
+type giftStats struct {
+	GiftName string  `json:"giftName"` // 礼物名字
+	Paid     bool    `json:"paid"`     // 是否付费礼物
+	Count    int64   `json:"count"`    // 礼物总数
+	Value    float64 `json:"value"`    // 礼物总价值，付费礼物时单位为AC币，免费礼物时单位为香蕉
+}
+
+// 弹幕最多的时刻
+type peakStats struct {
+	Minute     int    `json:"minute"`     // 相对于直播开始的分钟数
+	Comments   int    `json:"comments"`   // 这一分钟的弹幕数量
+	TopContent string `json:"topContent"` // 这一分钟出现最多的弹幕内容
+}
+
+// 直播弹幕的统计报告
+type danmuReport struct {
+	UID           int           `json:"uid"`           // 主播uid
+	Name          string        `json:"name"`          // 主播名字
+	LiveID        string        `json:"liveID"`        // 直播ID
+	Title         string        `json:"title"`         // 直播间标题
+	StartTime     int64         `json:"startTime"`     // 弹幕下载开始的时间，是以毫秒为单位的Unix时间
+	EndTime       int64         `json:"endTime"`       // 弹幕下载结束的时间，是以毫秒为单位的Unix时间
+	TotalComments int           `json:"totalComments"` // 弹幕总数
+	UniqueSenders int           `json:"uniqueSenders"` // 发送弹幕的用户数量
+	TopSenders    []senderStats `json:"topSenders"`    // 发送弹幕最多的用户
+	CommentRate   []int         `json:"commentRate"`   // 每分钟的弹幕数量
+	Gifts         []giftStats   `json:"gifts"`         // 各种礼物的统计，按价值排序
+	GiftValue     float64       `json:"giftValue"`     // 付费礼物的总价值，单位为AC币
+	BananaCount   int64         `json:"bananaCount"`   // 香蕉总数
+	Peaks         []peakStats   `json:"peaks"`         // 弹幕最多的时刻
+	Dropped       int           `json:"dropped"`       // 没有写入弹幕文件的被过滤的弹幕数量
+}
+
+// 统计直播弹幕，实现danmuWriter，弹幕下载重启时继续统计
+type danmuStats struct {
+	s         streamer
+	info      liveInfo
+	comments  int
+	senders   map[int64]*senderStats
+	rate      []int
+	contents  map[int]map[string]int // 每分钟各种弹幕内容的数量
+	gifts     map[string]*giftStats
+	startTime int64        // 以纳秒为单位的Unix时间
+	filter    *danmuFilter // 用来获取被过滤的弹幕数量
+}
+
+// 最近一次直播的弹幕统计报告，key为主播uid
+var danmuReports struct {
+	sync.Mutex
+	report map[int]danmuReport
+}
+
+// 新建danmuStats
+func newDanmuStats(s streamer, info liveInfo) *danmuStats {
+	return &danmuStats{
+		s:         s,
+		info:      info,
+		senders:   make(map[int64]*senderStats),
+		contents:  make(map[int]map[string]int),
+		gifts:     make(map[string]*giftStats),
+		startTime: info.cfg.StartTime,
+	}
+}
+
+// 获取相对于直播开始的分钟数
+func (st *danmuStats) minute(sendTime int64) int {
+	m := int((sendTime*1e6 - st.startTime) / int64(time.Minute))
+	if m < 0 {
+		return 0
+	}
+	return m
+}
+
+// 统计一条弹幕
+func (st *danmuStats) writeDanmu(d acfundanmu.DanmuMessage) error {
+	switch d := d.(type) {
+	case *acfundanmu.Comment:
+		st.comments++
+		sender, ok := st.senders[d.UserID]
+		if !ok {
+			sender = &senderStats{UserID: d.UserID}
+			st.senders[d.UserID] = sender
+		}
+		sender.Nickname = d.Nickname
+		sender.Comments++
+		m := st.minute(d.SendTime)
+		for len(st.rate) <= m {
+			st.rate = append(st.rate, 0)
+		}
+		st.rate[m]++
+		if st.contents[m] == nil {
+			st.contents[m] = make(map[string]int)
+		}
+		st.contents[m][d.Content]++
+	case *acfundanmu.Gift:
+		count := int64(d.Count) * int64(d.Combo)
+		if count == 0 {
+			count = int64(d.Count)
+		}
+		paid := d.PayWalletType == 1
+		value := float64(d.Value)
+		if paid {
+			value /= 1000
+		}
+		st.addGift(d.GiftName, paid, count, value)
+	case *acfundanmu.ThrowBanana:
+		st.addGift("香蕉", false, int64(d.BananaCount), float64(d.BananaCount))
+	}
+	return nil
+}
+
+// 统计礼物
+func (st *danmuStats) addGift(name string, paid bool, count int64, value float64) {
+	key := fmt.Sprintf("%s-%t", name, paid)
+	g, ok := st.gifts[key]
+	if !ok {
+		g = &giftStats{GiftName: name, Paid: paid}
+		st.gifts[key] = g
+	}
+	g.Count += count
+	g.Value += value
+}
+
+// 统计不需要flush
+func (st *danmuStats) flush() error {
+	return nil
+}
+
+// 弹幕下载重启时继续统计，所以不做任何事情
+func (st *danmuStats) close() error {
+	return nil
+}
+
+// 生成统计报告
+func (st *danmuStats) report() danmuReport {
+	r := danmuReport{
+		UID:           st.s.UID,
+		Name:          st.s.Name,
+		LiveID:        st.info.LiveID,
+		Title:         st.info.Title,
+		StartTime:     st.startTime / 1e6,
+		EndTime:       time.Now().UnixMilli(),
+		TotalComments: st.comments,
+		UniqueSenders: len(st.senders),
+		TopSenders:    []senderStats{},
+		CommentRate:   append([]int{}, st.rate...),
+		Gifts:         []giftStats{},
+		Peaks:         []peakStats{},
+	}
+
+	if st.filter != nil {
+		r.Dropped = st.filter.dropped
+	}
+
+	for _, sender := range st.senders {
+		r.TopSenders = append(r.TopSenders, *sender)
+	}
+	sort.Slice(r.TopSenders, func(i, j int) bool {
+		if r.TopSenders[i].Comments != r.TopSenders[j].Comments {
+			return r.TopSenders[i].Comments > r.TopSenders[j].Comments
+		}
+		return r.TopSenders[i].UserID < r.TopSenders[j].UserID
+	})
+	if len(r.TopSenders) > statsTopSenders {
+		r.TopSenders = r.TopSenders[:statsTopSenders]
+	}
+
+	for _, g := range st.gifts {
+		r.Gifts = append(r.Gifts, *g)
+		if g.Paid {
+			r.GiftValue += g.Value
+		} else {
+			r.BananaCount += int64(g.Value)
+		}
+	}
+	sort.Slice(r.Gifts, func(i, j int) bool {
+		if r.Gifts[i].Paid != r.Gifts[j].Paid {
+			return r.Gifts[i].Paid
+		}
+		if r.Gifts[i].Value != r.Gifts[j].Value {
+			return r.Gifts[i].Value > r.Gifts[j].Value
+		}
+		return r.Gifts[i].GiftName < r.Gifts[j].GiftName
+	})
+
+	for m, n := range st.rate {
+		if n > 0 {
+			r.Peaks = append(r.Peaks, peakStats{Minute: m, Comments: n})
+		}
+	}
+	sort.SliceStable(r.Peaks, func(i, j int) bool {
+		return r.Peaks[i].Comments > r.Peaks[j].Comments
+	})
+	if len(r.Peaks) > statsPeaks {
+		r.Peaks = r.Peaks[:statsPeaks]
+	}
+	for i := range r.Peaks {
+		most := 0
+		for content, n := range st.contents[r.Peaks[i].Minute] {
+			if n > most || (n == most && content < r.Peaks[i].TopContent) {
+				most = n
+				r.Peaks[i].TopContent = content
+			}
+		}
+	}
+
+	return r
+}
+
+// 将分钟数转换为时:分
+func minuteString(m int) string {
+	return fmt.Sprintf("%02d:%02d", m/60, m%60)
+}
+
+// 生成Markdown格式的统计报告
+func (r danmuReport) markdown() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s的直播弹幕统计\n\n", r.Name)
+	fmt.Fprintf(&b, "- 直播间标题：%s\n", r.Title)
+	fmt.Fprintf(&b, "- liveID：%s\n", r.LiveID)
+	fmt.Fprintf(&b, "- 统计时间：%s 至 %s\n",
+		time.UnixMilli(r.StartTime).Format("2006-01-02 15:04:05"), time.UnixMilli(r.EndTime).Format("2006-01-02 15:04:05"))
+	fmt.Fprintf(&b, "- 弹幕总数：%d\n", r.TotalComments)
+	fmt.Fprintf(&b, "- 发送弹幕的人数：%d\n", r.UniqueSenders)
+	fmt.Fprintf(&b, "- 付费礼物总价值：%gAC币\n", r.GiftValue)
+	fmt.Fprintf(&b, "- 香蕉总数：%d\n", r.BananaCount)
+	fmt.Fprintf(&b, "- 被过滤的弹幕数量：%d\n", r.Dropped)
+
+	b.WriteString("\n## 发送弹幕最多的用户\n\n| 用户 | uid | 弹幕数量 |\n| --- | --- | --- |\n")
+	for _, sender := range r.TopSenders {
+		fmt.Fprintf(&b, "| %s | %d | %d |\n", markdownEscape(sender.Nickname), sender.UserID, sender.Comments)
+	}
+
+	b.WriteString("\n## 礼物\n\n| 礼物 | 数量 | 价值 |\n| --- | --- | --- |\n")
+	for _, g := range r.Gifts {
+		unit := "香蕉"
+		if g.Paid {
+			unit = "AC币"
+		}
+		fmt.Fprintf(&b, "| %s | %d | %g%s |\n", markdownEscape(g.GiftName), g.Count, g.Value, unit)
+	}
+
+	b.WriteString("\n## 弹幕高峰\n\n| 时间 | 弹幕数量 | 最多的弹幕 |\n| --- | --- | --- |\n")
+	for _, p := range r.Peaks {
+		fmt.Fprintf(&b, "| %s | %d | %s |\n", minuteString(p.Minute), p.Comments, markdownEscape(p.TopContent))
+	}
+
+	b.WriteString("\n## 每分钟弹幕数量\n\n| 时间 | 弹幕数量 |\n| --- | --- |\n")
+	for m, n := range r.CommentRate {
+		fmt.Fprintf(&b, "| %s | %d |\n", minuteString(m), n)
+	}
+
+	return b.String()
+}
+
+// 转义Markdown表格里的特殊字符
+func markdownEscape(s string) string {
+	s = strings.ReplaceAll(s, "|", `\|`)
+	return strings.ReplaceAll(s, "\n", " ")
+}
+
+// 生成用于QQ消息的简短统计
+func (r danmuReport) summary() string {
+	text := fmt.Sprintf("%s的直播弹幕统计：弹幕%d条，%d人发送弹幕，付费礼物价值%gAC币，香蕉%d个",
+		r.Name, r.TotalComments, r.UniqueSenders, r.GiftValue, r.BananaCount)
+	if len(r.TopSenders) != 0 {
+		text += fmt.Sprintf("，发送弹幕最多的是%s（%d条）", r.TopSenders[0].Nickname, r.TopSenders[0].Comments)
+	}
+	if len(r.Peaks) != 0 {
+		text += fmt.Sprintf("，弹幕高峰在%s（%d条）", minuteString(r.Peaks[0].Minute), r.Peaks[0].Comments)
+	}
+	return text
+}
+
+// 获取统计报告的文件路径
+func (info *liveInfo) statsFiles() (jsonFile, mdFile string) {
+	return info.danmuFile(".stats.json"), info.danmuFile(".stats.md")
+}
+
+// 保存统计报告，并发送到QQ
+func (st *danmuStats) save() {
+	defer func() {
+		if err := recover(); err != nil {
+			lPrintErr("Recovering from panic in save(), the error is:", err)
+			lPrintErrf("保存%s的直播弹幕统计时发生错误", st.s.longID())
+		}
+	}()
+
+	r := st.report()
+	danmuReports.Lock()
+	danmuReports.report[r.UID] = r
+	danmuReports.Unlock()
+
+	jsonFile, mdFile := st.info.statsFiles()
+	data, err := json.MarshalIndent(r, "", "    ")
+	checkErr(err)
+	err = os.WriteFile(jsonFile, data, 0644)
+	checkErr(err)
+	err = os.WriteFile(mdFile, []byte(r.markdown()), 0644)
+	checkErr(err)
+	lPrintln(st.s.longID() + "的直播弹幕统计保存在" + jsonFile + " " + mdFile)
+
+	if st.s.DanmuStatsQQ {
+		st.s.sendMirai(r.summary(), false)
+	}
+}
+
+// 获取指定主播最近一次直播的弹幕统计报告
+func getDanmuReport(uid int) (r danmuReport, ok bool) {
+	danmuReports.Lock()
+	defer danmuReports.Unlock()
+	r, ok = danmuReports.report[uid]
+	return r, ok
+}
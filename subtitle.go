@@ -0,0 +1,502 @@
+// 弹幕字幕相关
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/orzogc/acfundanmu"
+)
+
+// ass文件的Script Info
+const assScriptInfo = `[Script Info]
+; LiveID: %s
+; StreamName: %s
+Title: %s
+ScriptType: v4.00+
+Collisions: Normal
+PlayResX: %d
+PlayResY: %d
+
+`
+
+// ass文件的V4+ Styles
+const assStyles = `[V4+ Styles]
+Format: Name, Fontname, Fontsize, PrimaryColour, SecondaryColour, OutlineColour, BackColour, Bold, Italic, Underline, StrikeOut, ScaleX, ScaleY, Spacing, Angle, BorderStyle, Outline, Shadow, Alignment, MarginL, MarginR, MarginV, Encoding
+Style: Danmu,%s,%d,&H%02[3]XFFFFFF,&H%02[3]XFFFFFF,&H%02[3]X000000,&H%02[3]X000000,0,0,0,0,100,100,0,0,1,%[4]g,0,2,20,20,2,0
+
+`
+
+// ass文件的Events
+const assEvents = `[Events]
+Format: Layer, Start, End, Style, Name, MarginL, MarginR, MarginV, Effect, Text
+`
+
+// ass弹幕字幕
+const assDialogue = `Dialogue: 0,%s,%s,Danmu,%s(%d),20,20,2,,{\move(%d,%d,%d,%d)}%s
+`
+
+// 弹幕在视频里持续的时间，单位为纳秒
+const danmuDuration = int64(10 * time.Second)
+
+// ass字幕的弹幕行数
+const assLanes = 100
+
+// ass弹幕字幕的样式，为0或空时使用默认值
+type assStyleData struct {
+	FontName     string  `json:"fontName"`     // 字体，默认为Microsoft YaHei
+	FontSize     int     `json:"fontSize"`     // 字体大小，默认根据视频分辨率设置
+	Speed        float64 `json:"speed"`        // 弹幕滚动速度（像素/秒），大于0时会忽略duration
+	Duration     float64 `json:"duration"`     // 弹幕从视频右边滚动到左边的秒数，默认为10
+	Opacity      float64 `json:"opacity"`      // 弹幕不透明度，范围为0到1，默认为1
+	Outline      float64 `json:"outline"`      // 弹幕描边宽度，默认为1，小于0时不描边
+	Lanes        int     `json:"lanes"`        // 弹幕最多行数，默认为100，不会超过视频能显示的行数
+	MarginTop    int     `json:"marginTop"`    // 弹幕区域距离视频顶部的像素
+	MarginBottom int     `json:"marginBottom"` // 弹幕区域距离视频底部的像素
+}
+
+// 将为0或空的样式设为默认值
+func (st assStyleData) withDefault() assStyleData {
+	if st.FontName == "" {
+		st.FontName = "Microsoft YaHei"
+	}
+	if st.Duration <= 0 {
+		st.Duration = float64(danmuDuration) / float64(time.Second)
+	}
+	if st.Opacity <= 0 || st.Opacity > 1 {
+		st.Opacity = 1
+	}
+	if st.Outline == 0 {
+		st.Outline = 1
+	} else if st.Outline < 0 {
+		st.Outline = 0
+	}
+	if st.Lanes <= 0 {
+		st.Lanes = assLanes
+	}
+	if st.MarginTop < 0 {
+		st.MarginTop = 0
+	}
+	if st.MarginBottom < 0 {
+		st.MarginBottom = 0
+	}
+	return st
+}
+
+// 将样式合并到根据视频分辨率得到的字幕设置上
+func (st assStyleData) mergeTo(cfg *acfundanmu.SubConfig) {
+	if st.FontSize > 0 {
+		cfg.FontSize = st.FontSize
+	}
+}
+
+// 计算弹幕碰撞需要的数据，单位为纳秒
+type danmuLane struct {
+	appear    int64 // 弹幕出现的时间
+	emerge    int64 // 整个弹幕完全出现在视频右边的时间
+	disappear int64 // 弹幕消失的时间
+}
+
+// 将相对于录播开始的时间（纳秒）转换为ass字幕的时间格式
+func assTime(d int64) string {
+	if d < 0 {
+		d = 0
+	}
+	t := time.Unix(0, d).UTC()
+	return fmt.Sprintf("%d:%02d:%02d.%02d", t.Hour(), t.Minute(), t.Second(), t.Nanosecond()/1e7)
+}
+
+// ass字幕里不能使用","，需要转换用户昵称
+func assName(name string) string {
+	return strings.ReplaceAll(name, ",", " ")
+}
+
+// 写入ass字幕
+type assWriter struct {
+	f        *os.File
+	cfg      acfundanmu.SubConfig
+	style    assStyleData
+	lastTime []danmuLane // 每一行最后的弹幕的时间
+}
+
+// 新建assWriter，newFile为true时覆盖写入，为false时只追加写入Dialogue字幕
+func newASSWriter(file string, info liveInfo, newFile bool) (*assWriter, error) {
+	w := &assWriter{
+		cfg:   info.cfg,
+		style: info.style.withDefault(),
+	}
+	// 分辨率很低时字体大小可能为0
+	if w.cfg.FontSize < 1 {
+		w.cfg.FontSize = 1
+	}
+	// 弹幕行数不能超过视频能显示的行数
+	lanes := (w.cfg.PlayResY - w.style.MarginTop - w.style.MarginBottom) / w.cfg.FontSize
+	if lanes > w.style.Lanes {
+		lanes = w.style.Lanes
+	}
+	if lanes < 1 {
+		lanes = 1
+	}
+	w.lastTime = make([]danmuLane, lanes)
+
+	var err error
+	if newFile {
+		w.f, err = os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			return nil, err
+		}
+		header := fmt.Sprintf(assScriptInfo, info.LiveID, info.StreamName, w.cfg.Title, w.cfg.PlayResX, w.cfg.PlayResY) +
+			fmt.Sprintf(assStyles, w.style.FontName, w.cfg.FontSize, int((1-w.style.Opacity)*255+0.5), w.style.Outline) +
+			assEvents
+		if _, err = w.f.WriteString(header); err != nil {
+			_ = w.f.Close()
+			return nil, err
+		}
+	} else {
+		w.f, err = os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return w, nil
+}
+
+// 写入一条弹幕，只处理评论弹幕
+func (w *assWriter) writeDanmu(d acfundanmu.DanmuMessage) error {
+	c, ok := d.(*acfundanmu.Comment)
+	if !ok {
+		return nil
+	}
+
+	s := w.cfg
+	length := utf8.RuneCountInString(c.Content) * s.FontSize
+	sendTime := c.SendTime*1e6 - s.StartTime
+	// 弹幕从出现到消失的时间
+	duration := int64(w.style.Duration * float64(time.Second))
+	if w.style.Speed > 0 {
+		duration = int64(float64(s.PlayResX+length) / w.style.Speed * float64(time.Second))
+	}
+	// leftTime就是弹幕运动到视频左边的时间
+	leftTime := sendTime + (int64(s.PlayResX)*duration)/int64(s.PlayResX+length)
+	dt := danmuLane{
+		appear:    sendTime,
+		emerge:    sendTime + (int64(length)*duration)/int64(s.PlayResX+length),
+		disappear: sendTime + duration,
+	}
+	for i, t := range w.lastTime {
+		// 防止弹幕发生碰撞重叠
+		if dt.appear > t.emerge && leftTime > t.disappear {
+			w.lastTime[i] = dt
+			_, err := fmt.Fprintf(w.f, assDialogue,
+				assTime(dt.appear),
+				assTime(dt.disappear),
+				assName(c.Nickname),
+				c.UserID,
+				s.PlayResX+length/2,
+				w.style.MarginTop+s.FontSize*(i+1),
+				-length/2,
+				w.style.MarginTop+s.FontSize*(i+1),
+				c.Content,
+			)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ass字幕直接写入文件，不需要flush
+func (w *assWriter) flush() error {
+	return nil
+}
+
+// 结束写入ass字幕
+func (w *assWriter) close() error {
+	return w.f.Close()
+}
+
+// Bilibili xml弹幕文件的开头
+const xmlHeader = `<?xml version="1.0" encoding="UTF-8"?>
+<i>
+<chatserver>chat.bilibili.com</chatserver>
+<chatid>0</chatid>
+<mission>0</mission>
+<maxlimit>0</maxlimit>
+<state>0</state>
+<real_name>0</real_name>
+<source>k-v</source>
+`
+
+// Bilibili xml弹幕文件的结尾
+const xmlFooter = "</i>\n"
+
+// Bilibili xml弹幕，p的格式为：出现时间（秒）,模式,字体大小,颜色,发送时间（Unix秒）,弹幕池,用户ID,弹幕ID
+const xmlDanmu = `<d p="%.3f,1,25,16777215,%d,0,%d,%d">%s</d>
+`
+
+// 写入Bilibili格式的xml弹幕
+type xmlWriter struct {
+	f         *os.File
+	startTime int64 // 录播开始的时间，是以纳秒为单位的Unix时间
+	id        int64 // 弹幕ID
+}
+
+// 新建xmlWriter，newFile为true时覆盖写入，为false时在原有弹幕后面追加写入
+func newXMLWriter(file string, info liveInfo, newFile bool) (*xmlWriter, error) {
+	w := &xmlWriter{startTime: info.cfg.StartTime}
+
+	var err error
+	if newFile {
+		w.f, err = os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = w.f.WriteString(xmlHeader); err != nil {
+			_ = w.f.Close()
+			return nil, err
+		}
+		return w, nil
+	}
+
+	// 弹幕ID接着原有的弹幕，防止重复
+	if data, err := os.ReadFile(file); err == nil {
+		w.id = int64(bytes.Count(data, []byte("<d p=")))
+	}
+	w.f, err = os.OpenFile(file, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	// 去掉文件结尾的</i>
+	if err = truncateSuffix(w.f, xmlFooter); err != nil {
+		_ = w.f.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// 如果文件f以suffix结尾，去掉suffix，并将写入位置移到文件结尾
+func truncateSuffix(f *os.File, suffix string) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+	if size >= int64(len(suffix)) {
+		buf := make([]byte, len(suffix))
+		if _, err = f.ReadAt(buf, size-int64(len(suffix))); err != nil {
+			return err
+		}
+		if string(buf) == suffix {
+			size -= int64(len(suffix))
+			if err = f.Truncate(size); err != nil {
+				return err
+			}
+		}
+	}
+	_, err = f.Seek(size, io.SeekStart)
+	return err
+}
+
+// 写入一条弹幕，只处理评论弹幕
+func (w *xmlWriter) writeDanmu(d acfundanmu.DanmuMessage) error {
+	c, ok := d.(*acfundanmu.Comment)
+	if !ok {
+		return nil
+	}
+
+	appear := float64(c.SendTime*1e6-w.startTime) / 1e9
+	if appear < 0 {
+		appear = 0
+	}
+	var content strings.Builder
+	if err := xml.EscapeText(&content, []byte(c.Content)); err != nil {
+		return err
+	}
+	w.id++
+	_, err := fmt.Fprintf(w.f, xmlDanmu, appear, c.SendTime/1e3, c.UserID, w.id, content.String())
+	return err
+}
+
+// xml弹幕直接写入文件，不需要flush
+func (w *xmlWriter) flush() error {
+	return nil
+}
+
+// 写入文件结尾并结束写入xml弹幕
+func (w *xmlWriter) close() error {
+	_, err := w.f.WriteString(xmlFooter)
+	if e := w.f.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// srt和vtt字幕的设置数据
+type textSubData struct {
+	MaxLines int     `json:"maxLines"` // 同时显示的弹幕最多行数
+	Duration float64 `json:"duration"` // 每条弹幕显示的秒数
+}
+
+// srt和vtt字幕里的一条弹幕
+type textSubLine struct {
+	appear int64  // 弹幕出现的时间，相对于录播开始，单位为毫秒
+	expire int64  // 弹幕消失的时间，相对于录播开始，单位为毫秒
+	text   string // 弹幕文字
+}
+
+// 写入srt或vtt字幕，同一时间显示最近的多条弹幕
+type textSubWriter struct {
+	f          *os.File
+	isVTT      bool          // 是否vtt字幕
+	startTime  int64         // 录播开始的时间，是以毫秒为单位的Unix时间
+	maxLines   int           // 同时显示的弹幕最多行数
+	duration   int64         // 每条弹幕显示的时间，单位为毫秒
+	window     []textSubLine // 正在显示的弹幕
+	lastChange int64         // 正在显示的弹幕最后一次变化的时间
+	index      int           // srt字幕的序号
+}
+
+// 新建textSubWriter，newFile为true时覆盖写入，为false时追加写入
+func newTextSubWriter(file string, info liveInfo, isVTT, newFile bool) (*textSubWriter, error) {
+	w := &textSubWriter{
+		isVTT:     isVTT,
+		startTime: info.cfg.StartTime / 1e6,
+		maxLines:  config.TextSub.MaxLines,
+		duration:  int64(config.TextSub.Duration * 1000),
+	}
+
+	var err error
+	if newFile {
+		w.f, err = os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			return nil, err
+		}
+		if isVTT {
+			if _, err = w.f.WriteString("WEBVTT\n\n"); err != nil {
+				_ = w.f.Close()
+				return nil, err
+			}
+		}
+		return w, nil
+	}
+
+	if !isVTT {
+		// srt字幕追加写入时序号接着原来的序号
+		if data, err := os.ReadFile(file); err == nil {
+			w.index = strings.Count(string(data), " --> ")
+		}
+	}
+	w.f, err = os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// 将毫秒转换为srt或vtt字幕的时间格式
+func (w *textSubWriter) timeString(ms int64) string {
+	if ms < 0 {
+		ms = 0
+	}
+	sep := ","
+	if w.isVTT {
+		sep = "."
+	}
+	return fmt.Sprintf("%02d:%02d:%02d%s%03d", ms/3600000, ms/60000%60, ms/1000%60, sep, ms%1000)
+}
+
+// 写入从start到end显示的字幕
+func (w *textSubWriter) writeCue(start, end int64) error {
+	if end <= start || len(w.window) == 0 {
+		return nil
+	}
+	lines := make([]string, len(w.window))
+	for i, l := range w.window {
+		lines[i] = l.text
+	}
+	var err error
+	if w.isVTT {
+		_, err = fmt.Fprintf(w.f, "%s --> %s\n%s\n\n", w.timeString(start), w.timeString(end), strings.Join(lines, "\n"))
+	} else {
+		w.index++
+		_, err = fmt.Fprintf(w.f, "%d\n%s --> %s\n%s\n\n", w.index, w.timeString(start), w.timeString(end), strings.Join(lines, "\n"))
+	}
+	return err
+}
+
+// 写入到t为止的字幕，中间有弹幕消失时分开写入
+func (w *textSubWriter) advance(t int64) error {
+	for len(w.window) != 0 && w.window[0].expire <= t {
+		expire := w.window[0].expire
+		if err := w.writeCue(w.lastChange, expire); err != nil {
+			return err
+		}
+		// 弹幕按出现时间排列，先出现的先消失
+		for len(w.window) != 0 && w.window[0].expire <= expire {
+			w.window = w.window[1:]
+		}
+		if expire > w.lastChange {
+			w.lastChange = expire
+		}
+	}
+	if err := w.writeCue(w.lastChange, t); err != nil {
+		return err
+	}
+	if t > w.lastChange {
+		w.lastChange = t
+	}
+	return nil
+}
+
+// 写入一条弹幕，只处理评论弹幕
+func (w *textSubWriter) writeDanmu(d acfundanmu.DanmuMessage) error {
+	c, ok := d.(*acfundanmu.Comment)
+	if !ok {
+		return nil
+	}
+
+	t := c.SendTime - w.startTime
+	if t < w.lastChange {
+		t = w.lastChange
+	}
+	if err := w.advance(t); err != nil {
+		return err
+	}
+
+	text := c.Nickname + "：" + strings.ReplaceAll(c.Content, "\n", " ")
+	if w.isVTT {
+		text = vttEscaper.Replace(text)
+	}
+	w.window = append(w.window, textSubLine{appear: t, expire: t + w.duration, text: text})
+	if len(w.window) > w.maxLines {
+		w.window = w.window[len(w.window)-w.maxLines:]
+	}
+	return nil
+}
+
+// vtt字幕需要转义的字符
+var vttEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// srt和vtt字幕直接写入文件，不需要flush
+func (w *textSubWriter) flush() error {
+	return nil
+}
+
+// 写入剩下的字幕并结束写入
+func (w *textSubWriter) close() error {
+	var err error
+	if len(w.window) != 0 {
+		err = w.advance(w.window[len(w.window)-1].expire)
+	}
+	if e := w.f.Close(); err == nil {
+		err = e
+	}
+	return err
+}
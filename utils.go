@@ -36,6 +36,7 @@ type controlMsg struct {
 type streamerInfo struct {
 	//streamer
 	ch     chan controlMsg // 控制信息
+	events chan liveEvent  // 直播状态变化的事件
 	modify bool
 }
 
@@ -47,6 +48,9 @@ type liveInfo struct {
 	isRecording  bool               // 是否正在下载直播
 	isDanmu      bool               // 是否正在下载直播弹幕
 	isKeepOnline bool               // 是否正在直播间挂机
+	isGiftLedger bool               // 是否正在记录直播礼物
+	isMetrics    bool               // 是否正在记录直播间观众数据
+	isModerate   bool               // 是否正在直播间执行房管规则
 	recordCh     chan control       // 控制录播的管道
 	ffmpegStdin  io.WriteCloser     // ffmpeg的stdin
 	recordCancel context.CancelFunc // 用来强行停止ffmpeg运行
@@ -62,6 +66,7 @@ type streamInfo struct {
 	hlsURL                string // hls直播源
 	flvURL                string // flv直播源
 	cfg                   acfundanmu.SubConfig
+	style                 assStyleData // ass弹幕字幕的样式
 }
 
 // streamerInfo的map
@@ -123,7 +128,9 @@ func runThrice(f func() error) error {
 		} else {
 			return nil
 		}
-		time.Sleep(2 * time.Second)
+		if retry < 2 {
+			time.Sleep(backoffDelay(retry + 1))
+		}
 	}
 	return fmt.Errorf("运行三次都出现错误：%v", err)
 }
@@ -0,0 +1,172 @@
+// 终端查看直播弹幕相关
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+
+	"github.com/mattn/go-colorable"
+	"github.com/orzogc/acfundanmu"
+)
+
+// 终端颜色
+const (
+	colorReset   = "\033[0m"
+	colorGray    = "\033[90m"
+	colorCyan    = "\033[36m"
+	colorYellow  = "\033[33m"
+	colorMagenta = "\033[35m"
+)
+
+// 正在终端查看的直播间，key为主播uid
+var danmuViewers struct {
+	sync.Mutex
+	cancel map[int]context.CancelFunc
+}
+
+// 将弹幕、礼物和进入直播间输出到终端，实现danmuWriter
+type danmuViewer struct {
+	out io.Writer
+}
+
+// 新建danmuViewer
+func newDanmuViewer() *danmuViewer {
+	return &danmuViewer{out: colorable.NewColorableStdout()}
+}
+
+// 输出一条弹幕
+func (v *danmuViewer) writeDanmu(d acfundanmu.DanmuMessage) error {
+	var line string
+	switch d := d.(type) {
+	case *acfundanmu.Comment:
+		line = colorCyan + d.Nickname + colorReset + "：" + d.Content
+	case *acfundanmu.Gift:
+		count := d.Count * d.Combo
+		if count == 0 {
+			count = d.Count
+		}
+		line = fmt.Sprintf("%s%s 送出%d个%s%s", colorYellow, d.Nickname, count, d.GiftName, colorReset)
+	case *acfundanmu.ThrowBanana:
+		line = fmt.Sprintf("%s%s 投喂%d个香蕉%s", colorYellow, d.Nickname, d.BananaCount, colorReset)
+	case *acfundanmu.EnterRoom:
+		line = colorGray + d.Nickname + " 进入直播间" + colorReset
+	case *acfundanmu.JoinClub:
+		line = colorMagenta + d.FansInfo.Nickname + " 加入守护团" + colorReset
+	default:
+		return nil
+	}
+	sendTime := time.UnixMilli(d.GetSendTime()).Format("15:04:05")
+	_, err := fmt.Fprintln(v.out, colorGray+sendTime+colorReset+" "+line)
+	return err
+}
+
+// 终端输出不需要flush
+func (v *danmuViewer) flush() error {
+	return nil
+}
+
+// 不需要关闭终端输出
+func (v *danmuViewer) close() error {
+	return nil
+}
+
+// 在终端查看直播间的弹幕，不写入任何文件，直播结束或ctx结束时返回
+func (s streamer) viewDanmu(ctx context.Context) {
+	defer func() {
+		if err := recover(); err != nil {
+			lPrintErr("Recovering from panic in viewDanmu(), the error is:", err)
+			lPrintErrf("查看%s的直播弹幕发生错误", s.longID())
+		}
+	}()
+
+	liveID := getLiveID(s.UID)
+	lPrintf("开始在终端查看%s的直播弹幕", s.longID())
+	viewer := newDanmuViewer()
+	for {
+		s.handleDanmu(ctx, s.connectDanmu(ctx, nil), []danmuWriter{viewer})
+		select {
+		case <-ctx.Done():
+			lPrintf("停止查看%s的直播弹幕", s.longID())
+			return
+		case <-time.After(10 * time.Second):
+		}
+		// 因意外断开连接时重新连接
+		if !s.isLiveOnByPage() || getLiveID(s.UID) != liveID {
+			lPrintf("%s的直播已经结束，停止查看直播弹幕", s.longID())
+			return
+		}
+		lPrintWarn("因意外断开" + s.longID() + "的直播间连接，尝试重新连接")
+	}
+}
+
+// 在终端查看指定主播的直播弹幕
+func watchDanmu(uid int) bool {
+	s, ok := getStreamer(uid)
+	if !ok {
+		name := getName(uid)
+		if name == "" {
+			lPrintWarnf("不存在uid为%d的用户", uid)
+			return false
+		}
+		s = streamer{UID: uid, Name: name}
+	}
+
+	if getLiveID(uid) == "" {
+		lPrintErr(s.longID() + "不在直播，取消查看直播弹幕")
+		return false
+	}
+
+	// 查看程序是否处于监听状态
+	if *isListen {
+		danmuViewers.Lock()
+		defer danmuViewers.Unlock()
+		if _, ok := danmuViewers.cancel[uid]; ok {
+			lPrintWarnf("已经在查看%s的直播弹幕，如要停止查看，请运行 stopwatchdanmu %d", s.longID(), uid)
+			return false
+		}
+		// 用-watchdanmu启动时还没开始监听
+		parent := mainCtx
+		if parent == nil {
+			parent = context.Background()
+		}
+		ctx, cancel := context.WithCancel(parent)
+		danmuViewers.cancel[uid] = cancel
+		lPrintf("如果想停止查看%s的直播弹幕，运行 stopwatchdanmu %d", s.longID(), uid)
+		go func() {
+			defer func() {
+				danmuViewers.Lock()
+				delete(danmuViewers.cancel, uid)
+				danmuViewers.Unlock()
+				cancel()
+			}()
+			s.viewDanmu(ctx)
+		}()
+	} else {
+		// 程序只在查看一个直播间的弹幕，按Ctrl+C结束
+		ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer cancel()
+		lPrintln("按Ctrl+C停止查看直播弹幕")
+		s.viewDanmu(ctx)
+	}
+
+	return true
+}
+
+// 停止在终端查看指定主播的直播弹幕
+func stopWatchDanmu(uid int) bool {
+	danmuViewers.Lock()
+	defer danmuViewers.Unlock()
+	cancel, ok := danmuViewers.cancel[uid]
+	if !ok {
+		lPrintWarnf("没有在查看uid为%d的主播的直播弹幕", uid)
+		return true
+	}
+	// 查看结束时才删除，防止重复查看
+	cancel()
+	return true
+}
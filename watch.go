@@ -0,0 +1,133 @@
+// 弹幕关键词和用户提醒相关
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/orzogc/acfundanmu"
+)
+
+// 弹幕提醒的规则
+type watchData struct {
+	Keywords []string `json:"keywords"` // 弹幕包含这些关键词时提醒
+	Regexps  []string `json:"regexps"`  // 弹幕符合这些正则表达式时提醒
+	UIDs     []int64  `json:"uids"`     // 这些uid的用户发送弹幕、送礼物或进入直播间时提醒
+}
+
+// 是否设置了弹幕提醒的规则
+func (w watchData) isEmpty() bool {
+	return len(w.Keywords) == 0 && len(w.Regexps) == 0 && len(w.UIDs) == 0
+}
+
+// 检查弹幕是否符合提醒规则，实现danmuWriter，弹幕下载重启时继续使用
+type danmuWatcher struct {
+	s          streamer
+	keywords   []string
+	regexps    []*regexp.Regexp
+	uids       map[int64]bool
+	lastAlert  time.Time // 上一次发送提醒的时间
+	suppressed int       // 因为频率限制没有发送提醒的匹配数量
+}
+
+// 新建danmuWatcher，没有设置规则时返回nil
+func newDanmuWatcher(s streamer) *danmuWatcher {
+	if s.Watch.isEmpty() {
+		return nil
+	}
+
+	w := &danmuWatcher{s: s, uids: make(map[int64]bool)}
+	for _, k := range s.Watch.Keywords {
+		if k != "" {
+			w.keywords = append(w.keywords, strings.ToLower(k))
+		}
+	}
+	for _, r := range s.Watch.Regexps {
+		re, err := regexp.Compile(r)
+		if err != nil {
+			lPrintErrf("%s里%s的watch有错误的正则表达式 %s ：%v", liveFile, s.longID(), r, err)
+			continue
+		}
+		w.regexps = append(w.regexps, re)
+	}
+	for _, uid := range s.Watch.UIDs {
+		w.uids[uid] = true
+	}
+
+	return w
+}
+
+// 检查弹幕内容是否符合关键词或正则表达式，返回匹配的规则
+func (w *danmuWatcher) matchContent(content string) string {
+	lower := strings.ToLower(content)
+	for _, k := range w.keywords {
+		if strings.Contains(lower, k) {
+			return "关键词 " + k
+		}
+	}
+	for _, re := range w.regexps {
+		if re.MatchString(content) {
+			return "正则表达式 " + re.String()
+		}
+	}
+	return ""
+}
+
+// 检查一条弹幕
+func (w *danmuWatcher) writeDanmu(d acfundanmu.DanmuMessage) error {
+	var user acfundanmu.UserInfo
+	var action string
+	switch d := d.(type) {
+	case *acfundanmu.Comment:
+		if rule := w.matchContent(d.Content); rule != "" {
+			w.alert(rule, fmt.Sprintf("%s（%d）：%s", d.Nickname, d.UserID, d.Content))
+			return nil
+		}
+		user, action = d.UserInfo, "："+d.Content
+	case *acfundanmu.Gift:
+		user, action = d.UserInfo, fmt.Sprintf("送出%d个%s", d.Count*d.Combo, d.GiftName)
+	case *acfundanmu.ThrowBanana:
+		user, action = d.UserInfo, fmt.Sprintf("投了%d个香蕉", d.BananaCount)
+	case *acfundanmu.EnterRoom:
+		user, action = d.UserInfo, "进入直播间"
+	case *acfundanmu.JoinClub:
+		user, action = d.FansInfo, "加入守护团"
+	default:
+		return nil
+	}
+	if w.uids[user.UserID] {
+		w.alert(fmt.Sprintf("uid %d", user.UserID), fmt.Sprintf("%s（%d）%s", user.Nickname, user.UserID, action))
+	}
+	return nil
+}
+
+// 发送提醒，两次提醒的间隔小于watchInterval时只记录到日志
+func (w *danmuWatcher) alert(rule, context string) {
+	msg := fmt.Sprintf("%s的直播间弹幕符合%s：%s", w.s.Name, rule, context)
+	lPrintln(msg)
+
+	interval := time.Duration(config.WatchInterval * float64(time.Second))
+	if time.Since(w.lastAlert) < interval {
+		w.suppressed++
+		return
+	}
+	if w.suppressed != 0 {
+		msg += fmt.Sprintf("（之前还有%d条符合提醒规则的弹幕，请查看日志）", w.suppressed)
+		w.suppressed = 0
+	}
+	w.lastAlert = time.Now()
+	desktopNotify(msg)
+	w.s.sendMirai(msg, false)
+}
+
+// 提醒不需要flush
+func (w *danmuWatcher) flush() error {
+	return nil
+}
+
+// 弹幕下载重启时继续使用，所以不做任何事情
+func (w *danmuWatcher) close() error {
+	return nil
+}
@@ -33,8 +33,37 @@ const webHelp = `/listlive ：列出正在直播的主播
 /delrecord/uid ：取消自动下载指定主播的直播视频
 /adddanmu/uid ：自动下载指定主播的直播弹幕
 /deldanmu/uid ：取消自动下载指定主播的直播弹幕
+/adddanmuarchive/uid ：下载指定主播的直播弹幕时将全部弹幕事件保存为jsonl存档
+/deldanmuarchive/uid ：取消保存指定主播的弹幕存档
 /addkeeponline/uid ：指定主播直播时在其直播间挂机
 /delkeeponline/uid ：取消在指定主播直播时在其直播间挂机
+/addburndanmu/uid ：下载指定主播的直播视频和弹幕结束后将弹幕压制到视频里
+/delburndanmu/uid ：取消压制指定主播的直播弹幕
+/addhighlight/uid ：下载指定主播的直播视频和弹幕结束后剪辑精彩片段
+/delhighlight/uid ：取消剪辑指定主播的直播精彩片段
+/addqualitycheck/uid ：下载指定主播的直播视频时检测黑屏、画面静止和无声
+/delqualitycheck/uid ：取消检测指定主播的直播画面和声音
+/adddanmustatsqq/uid ：指定主播的直播弹幕下载结束时将弹幕统计发送到QQ
+/deldanmustatsqq/uid ：取消将指定主播的弹幕统计发送到QQ
+/danmustats/uid ：查看指定主播最近一次直播的弹幕统计
+/addgiftledger/uid ：将指定主播的直播收到的礼物记录到礼物账本
+/delgiftledger/uid ：取消记录指定主播的直播礼物
+/addmetrics/uid ：定时记录指定主播的直播间观众数据
+/delmetrics/uid ：取消记录指定主播的直播间观众数据
+/addmoderate/uid ：在指定主播的直播间自动执行房管规则
+/delmoderate/uid ：取消在指定主播的直播间执行房管规则
+/addmoderatedryrun/uid ：只记录房管规则将要进行的操作，不真正踢人
+/delmoderatedryrun/uid ：房管规则真正踢人
+/senddanmu/uid/弹幕内容 ：用登陆的AcFun帐号发送弹幕到指定主播的直播间，弹幕内容需要URL编码
+/moderatelog ：查看最近的房管操作记录
+/moderatelog/uid ：查看指定主播的直播间最近的房管操作记录
+/history/uid?from=开始日期&to=结束日期 ：查看指定主播的直播历史，日期格式为2006-01-02，from和to可以不设置
+/schedule/uid ：查看根据直播历史统计的指定主播的直播时间表
+/schedule/uid.ics ：订阅指定主播的直播时间表的iCalendar日历，包括固定直播时段和最近的直播
+/giftsession ：按直播汇总礼物账本里所有主播收到的礼物
+/giftsession/uid ：按直播汇总礼物账本里指定主播收到的礼物
+/giftday ：按天汇总礼物账本里所有主播收到的礼物
+/giftday/uid ：按天汇总礼物账本里指定主播收到的礼物
 /delconfig/uid：删除指定主播的所有设置
 /getdlurl/uid ：查看指定主播是否在直播，如在直播输出其直播源地址
 /addqq/uid/QQ号：设置将指定主播的开播提醒发送到指定QQ号
@@ -100,6 +129,42 @@ func cmdQQHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// 处理 "/senddanmu/uid/弹幕内容"
+func sendDanmuHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	uid, err := atoi(vars["uid"])
+	checkErr(err)
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, sendDanmu(uid, vars["text"]))
+}
+
+// 处理 "/history/uid?from=开始日期&to=结束日期"
+func historyHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	uid, err := atoi(vars["uid"])
+	checkErr(err)
+	w.Header().Set("Content-Type", "application/json")
+	if s := historyJSON(uid, r.FormValue("from"), r.FormValue("to")); s != "" {
+		fmt.Fprint(w, s)
+	} else {
+		fmt.Fprint(w, "null")
+	}
+}
+
+// 处理 "/schedule/uid.ics"
+func scheduleICalHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	uid, err := atoi(vars["uid"])
+	checkErr(err)
+	s := scheduleICal(uid)
+	if s == "" {
+		http.Error(w, "统计直播时间表失败", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	fmt.Fprint(w, s)
+}
+
 // 显示favicon
 func faviconHandler(w http.ResponseWriter, r *http.Request) {
 	http.ServeFile(w, r, logoFile)
@@ -145,6 +210,9 @@ func webAPI() {
 	r.HandleFunc("/log", logHandler)
 	r.HandleFunc("/help", helpHandler)
 	r.HandleFunc("/", helpHandler)
+	r.HandleFunc("/senddanmu/{uid:[1-9][0-9]*}/{text:.+}", sendDanmuHandler)
+	r.HandleFunc("/history/{uid:[1-9][0-9]*}", historyHandler)
+	r.HandleFunc("/schedule/{uid:[1-9][0-9]*}.ics", scheduleICalHandler)
 	r.HandleFunc("/{cmd}", cmdHandler)
 	r.HandleFunc("/{cmd}/{uid:[1-9][0-9]*}", cmdUIDHandler)
 	r.HandleFunc("/{cmd}/{uid:[1-9][0-9]*}/{qq:[1-9][0-9]*}", cmdQQHandler)